@@ -1,26 +1,136 @@
 package main
 
 import (
+	"context"
 	"log"
+	"log/slog"
+	"os"
+	"os/signal"
 	"rinha-2025-go/internal/config"
 	"rinha-2025-go/internal/database"
 	"rinha-2025-go/internal/server"
 	"rinha-2025-go/internal/services"
+	"rinha-2025-go/pkg/logging"
+	"rinha-2025-go/pkg/tracing"
+	"rinha-2025-go/pkg/wal"
+	"syscall"
 )
 
 func main() {
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	// Root of the background work, cancelled once shutdown is over.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	cfg := config.ConfigInstance().Init()
-	redis := database.NewRedisClient(cfg)
-	defer redis.Close()
+	if err := logging.Init(cfg.Log); err != nil {
+		log.Fatalln("logging:", err)
+	}
+	if err := tracing.Init(cfg.Tracing); err != nil {
+		fatal("failed to start tracing", err)
+	}
+	defer tracing.Shutdown()
+	store, queue := openStorage(ctx, cfg)
+	if cfg.Ledger.Backend == "postgres" {
+		ledger, err := database.NewPostgres(ctx, &cfg.Ledger)
+		if err != nil {
+			fatal("failed to open ledger", err)
+		}
+		store = services.WithLedger(store, ledger)
+	}
+	defer store.Close()
 	client := services.NewHttpClient()
-	health := services.NewHealth(cfg, redis, client)
-	defer health.Close()
-	go health.ProcessServicesHealth()
-	worker := services.NewPaymentWorker(cfg, redis, client, health)
+	health := services.NewHealth(cfg, store, client, queue)
+	slog.Info("routing strategy", "router", cfg.Router.Strategy)
+	go health.ProcessServicesHealth(ctx)
+	go health.ProcessForwardStats(ctx)
+	var paymentLog *wal.Log
+	var logged []wal.Record
+	if cfg.WAL.Dir != "" {
+		var err error
+		if paymentLog, logged, err = wal.Open(cfg.WAL); err != nil {
+			fatal("failed to open write-ahead log", err)
+		}
+		defer paymentLog.Close()
+	}
+	worker := services.NewPaymentWorker(ctx, cfg, store, client, health, queue, paymentLog)
 	defer worker.Close()
-	log.Println("Starting workers:", cfg.NumWorkers)
-	for range cfg.NumWorkers {
-		go worker.ProcessQueue()
+	slog.Info("starting workers", "workers", cfg.GetNumWorkers(), "queueConsumers", cfg.NumQueueConsumers)
+	worker.SetWorkers(cfg.GetNumWorkers())
+	worker.Start(ctx, cfg.NumQueueConsumers)
+	worker.Replay(logged)
+	go watchReload(cfg, worker)
+
+	srv := server.NewServer(cfg, worker)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		fatal("server stopped", err)
+	case <-signalCtx.Done():
+	}
+	stop() // A second signal kills the process right away.
+	shutdown(cfg, srv, health, worker)
+	cancel()
+}
+
+// shutdown stops the instance within cfg.ShutdownTimeout: no new requests,
+// then the worker is drained. The store and the tracer are closed by the
+// deferred calls in main afterwards.
+func shutdown(cfg *config.Config, srv *server.Server, health *services.Health, worker *services.PaymentWorker) {
+	slog.Info("shutting down", "timeout", cfg.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("server shutdown failed", logging.Err(err))
+	}
+	health.Shutdown(ctx)
+	if err := worker.Shutdown(ctx); err != nil {
+		slog.Error("worker shutdown incomplete", logging.Err(err))
+		return
+	}
+	slog.Info("shutdown complete")
+}
+
+// openStorage returns the store and the queue selected by cfg.Storage: Redis,
+// shared by every instance, or the in-process embedded backend.
+func openStorage(ctx context.Context, cfg *config.Config) (services.Store, services.Queue) {
+	if cfg.Storage == "embedded" {
+		memory, err := database.NewMemory(cfg)
+		if err != nil {
+			fatal("failed to open embedded store", err)
+		}
+		slog.Info("running in embedded mode", "snapshot", cfg.SnapshotFile)
+		return memory, database.NewMemoryQueue()
+	}
+	redis, err := database.NewRedisClient(ctx, cfg)
+	if err != nil {
+		fatal("failed to open redis", err)
+	}
+	if err := redis.MigrateSummaries(ctx, cfg.GetServices().All()); err != nil {
+		fatal("failed to migrate summaries", err)
+	}
+	return redis, database.NewRedisQueue(ctx, cfg, redis)
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, logging.Err(err))
+	os.Exit(1)
+}
+
+// watchReload applies the runtime-safe part of the configuration on SIGHUP.
+func watchReload(cfg *config.Config, worker *services.PaymentWorker) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := cfg.Reload(); err != nil {
+			slog.Error("reload failed, keeping current configuration", logging.Err(err))
+			continue
+		}
+		worker.SetWorkers(cfg.GetNumWorkers())
+		slog.Info("configuration reloaded", "workers", cfg.GetNumWorkers(),
+			"processors", len(cfg.GetServices().Processors))
 	}
-	log.Fatalln(server.RunServer(cfg, worker))
 }
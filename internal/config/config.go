@@ -1,44 +1,150 @@
 package config
 
 import (
-	"fmt"
 	"log"
-	"rinha-2025-go/pkg/utils"
+	"rinha-2025-go/pkg/logging"
+	"rinha-2025-go/pkg/tracing"
+	"rinha-2025-go/pkg/wal"
 	"runtime"
-	"strconv"
+	"slices"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
 )
 
 type Service struct {
-	URL   string  `json:"url"`
-	Table string  `json:"table"`
-	Token string  `json:"token"`
-	Fee   float64 `json:"fee"`
+	Name     string  `json:"name"`
+	URL      string  `json:"url"`
+	Table    string  `json:"table"`
+	Token    string  `json:"token"`
+	Fee      float64 `json:"fee"`
+	Priority int     `json:"priority"`
 
 	Failing         bool
 	MinResponseTime uint32
 	Timeout         time.Duration
 	KeyAmount       string
 	KeyTime         string
+	KeySeconds      string // Per-second summary buckets
+	KeyMinutes      string // Per-minute summary buckets
+	KeyMinuteIndex  string // Sorted set of the minutes holding a bucket
 }
 
+// Services is the registry of payment processors, ordered by priority
+// (lowest first).
 type Services struct {
-	Default  Service
-	Fallback Service
+	Processors []Service
 }
 
+// All returns pointers to the registered processors in priority order.
+func (s *Services) All() []*Service {
+	res := make([]*Service, len(s.Processors))
+	for i := range s.Processors {
+		res[i] = &s.Processors[i]
+	}
+	return res
+}
+
+func (s *Services) ByTable(table string) *Service {
+	for i := range s.Processors {
+		if s.Processors[i].Table == table {
+			return &s.Processors[i]
+		}
+	}
+	return nil
+}
+
+// Clone returns a copy whose processors can be modified independently.
+func (s *Services) Clone() *Services {
+	return &Services{Processors: slices.Clone(s.Processors)}
+}
+
+// RetryRule overrides the retry policy for one processor status code.
+// Status 0 stands for requests that got no response at all.
+type RetryRule struct {
+	NoRetry   bool
+	BaseDelay time.Duration
+}
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Jitter      float64 // Fraction of each delay that is randomized (0 to 1)
+	Rules       map[int]RetryRule
+}
+
+type BreakerConfig struct {
+	FailureThreshold int           // Consecutive failures that open the breaker
+	OpenTimeout      time.Duration // Time before an open breaker lets a probe through
+	SlowCall         time.Duration // Successful calls slower than this count as failures (0 disables)
+}
+
+type RouterConfig struct {
+	Strategy         string        // threshold or cost
+	LatencyThreshold time.Duration // threshold: response time under which a processor is kept
+	LatencyBudget    time.Duration // cost: response time worth one LatencyWeight
+	LatencyWeight    float64       // cost: fee-equivalent penalty per LatencyBudget
+	FailureWeight    float64       // cost: fee-equivalent penalty for a 100% failure rate
+	QueueScale       int64         // cost: backlog that doubles the latency penalty (0 disables)
+}
+
+// LedgerConfig selects where the summaries of forwarded payments are kept.
+type LedgerConfig struct {
+	Backend       string // redis or postgres
+	PostgresURL   string
+	PoolSize      int
+	BatchSize     int           // Payments written per INSERT at most
+	BatchInterval time.Duration // Longest a payment waits for its batch to fill
+}
+
+// ReconcileConfig drives the periodic comparison of the stored summaries
+// with the admin summaries of the processors.
+type ReconcileConfig struct {
+	Interval   time.Duration // Time between runs; 0 disables reconciliation
+	Window     time.Duration // Span checked by each run
+	Lag        time.Duration // How far before now the window ends, so payments being forwarded settle
+	Resolution time.Duration // Bisection stops at ranges this short
+}
+
+// Config holds the service settings. It is loaded from defaults, then the
+// optional JSON file named by CONFIG_FILE, then environment variables.
+//
+// The processor registry, the health refresh interval and the worker count
+// can be reloaded at runtime (see Reload) and are only reachable through
+// their getters; every other field is fixed at startup.
 type Config struct {
 	ServerSocket           string
+	Storage                string // redis, or embedded to run a single instance without Redis
+	SnapshotFile           string // embedded: where summaries are persisted ("" disables)
+	SnapshotInterval       time.Duration
 	RedisSocket            string
+	RedisPoolSize          int
 	RedisReadTimeout       time.Duration
 	RedisWriteTimeout      time.Duration
 	RedisPoolTimeout       time.Duration
 	ActiveInstance         *Service
-	Services               Services
-	ServiceRefreshInterval time.Duration
-	NumWorkers             int
+	NumQueueConsumers      int
+	QueueMode              string
+	QueueVisibilityTimeout time.Duration
+	QueueReadyMaxDepth     int64 // Backlog above which the instance is not ready; 0 disables the check
+	IdempotencyTTL         time.Duration
+	ShutdownTimeout        time.Duration
+	RequestTimeout         time.Duration
+	Retry                  RetryPolicy
+	Breaker                BreakerConfig
+	Router                 RouterConfig
+	Ledger                 LedgerConfig
+	Reconcile              ReconcileConfig
+	MaxProcs               int
+	Tracing                tracing.Config
+	Log                    logging.Config
+	WAL                    wal.Config
+
+	services               atomic.Pointer[Services]
+	serviceRefreshInterval atomic.Int64
+	numWorkers             atomic.Int64
 }
 
 var appConfig Config
@@ -48,11 +154,19 @@ func ConfigInstance() *Config {
 }
 
 func (c *Config) GetServices() *Services {
-	return &c.Services
+	return c.services.Load()
 }
 
 func (c *Config) SetServices(services *Services) {
-	c.Services = *services
+	c.services.Store(services)
+}
+
+func (c *Config) GetServiceRefreshInterval() time.Duration {
+	return time.Duration(c.serviceRefreshInterval.Load())
+}
+
+func (c *Config) GetNumWorkers() int {
+	return int(c.numWorkers.Load())
 }
 
 func (c *Config) GetActiveInstance() *Service {
@@ -63,39 +177,25 @@ func (c *Config) SetActiveInstance(activeService *Service) {
 }
 
 func (c *Config) Init() *Config {
-	c.Services.Default.URL = utils.GetEnvOr("DEFAULT_URL", "http://payment-processor-default:8080")
-	c.Services.Default.Table = "d"
-	c.Services.Default.Token = "123"
-	c.Services.Default.KeyAmount = fmt.Sprintf("summary:%s:data", c.Services.Default.Table)
-	c.Services.Default.KeyTime = fmt.Sprintf("summary:%s:history", c.Services.Default.Table)
-	c.Services.Default.Timeout = 10 * time.Second
-
-	c.Services.Fallback.URL = utils.GetEnvOr("FALLBACK_URL", "http://payment-processor-fallback:8080")
-	c.Services.Fallback.Table = "f"
-	c.Services.Fallback.Token = "123"
-	c.Services.Fallback.KeyAmount = fmt.Sprintf("summary:%s:data", c.Services.Fallback.Table)
-	c.Services.Fallback.KeyTime = fmt.Sprintf("summary:%s:history", c.Services.Fallback.Table)
-	c.Services.Fallback.Timeout = 10 * time.Second
-
-	c.ServiceRefreshInterval = 5 * time.Second
-	c.ActiveInstance = &c.Services.Default
-	c.RedisSocket = utils.GetEnvOr("REDIS_SOCKET", "/sockets/redis.sock")
-	c.RedisReadTimeout = utils.GetEnvDurationOr("REDIS_READ_TIMEOUT", 5*time.Second)
-	c.RedisWriteTimeout = utils.GetEnvDurationOr("REDIS_WRITE_TIMEOUT", 5*time.Second)
-	c.RedisPoolTimeout = utils.GetEnvDurationOr("REDIS_POOL_TIMEOUT", 10*time.Second)
-	c.ServerSocket = utils.GetEnvOr("SERVER_SOCKET", "")
-
-	workers, err := strconv.Atoi(utils.GetEnvOr("NUM_WORKERS", "50"))
-	if err != nil {
-		log.Fatal("error parsing NUM_WORKERS:", err)
+	if err := c.load(); err != nil {
+		log.Fatal("invalid configuration:\n", err)
 	}
-	c.NumWorkers = workers
+	c.ActiveInstance = &c.GetServices().Processors[0]
+	runtime.GOMAXPROCS(c.MaxProcs)
+	return c
+}
 
-	GOMAXPROCS, err := strconv.Atoi(utils.GetEnvOr("GOMAXPROCS", "3"))
-	if err != nil {
-		log.Fatal("error parsing GOMAXPROCS:", err)
+// Reload reads the configuration again and applies the fields that are safe
+// to change at runtime: the processor registry (including processor
+// timeouts), the health refresh interval and the worker count. Nothing is
+// applied if the new configuration is invalid.
+func (c *Config) Reload() error {
+	var next Config
+	if err := next.load(); err != nil {
+		return err
 	}
-	runtime.GOMAXPROCS(GOMAXPROCS)
-
-	return c
+	c.SetServices(next.GetServices())
+	c.serviceRefreshInterval.Store(next.serviceRefreshInterval.Load())
+	c.numWorkers.Store(next.numWorkers.Load())
+	return nil
 }
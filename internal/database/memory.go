@@ -0,0 +1,480 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"rinha-2025-go/internal/config"
+	"rinha-2025-go/internal/models"
+	"rinha-2025-go/pkg/logging"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ohler55/ojg/oj"
+)
+
+// Memory is the store of the embedded mode, where a single instance runs
+// without Redis. Everything is kept in process. Summaries and dead letters
+// are written to a snapshot file periodically and on Close, and loaded back
+// by NewMemory; idempotency records, health and locks start empty.
+type Memory struct {
+	mu          sync.Mutex
+	payments    map[string]*memoryPayment
+	summaries   map[string]map[string]memoryEntry // By table, then correlationId
+	deadLetters map[string]*models.DeadLetter
+	health      map[string]string
+	runTimes    map[string]time.Time
+	breakers    map[string]*memoryBreaker
+	forwards    map[forwardKey]*memoryForward
+	locks       map[string]memoryLock
+
+	snapshotFile string
+	done         chan struct{}
+	wg           sync.WaitGroup
+}
+
+// memoryPayment mirrors the idempotency hash and lease key of Redis. A zero
+// time never expires.
+type memoryPayment struct {
+	state      string
+	instance   string
+	expires    time.Time
+	leaseUntil time.Time
+}
+
+type memoryEntry struct {
+	Amount      models.Money `json:"amount"`
+	RequestedAt time.Time    `json:"requestedAt"`
+}
+
+type memoryBreaker struct {
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+type forwardKey struct {
+	table  string
+	bucket int64
+}
+
+type memoryForward struct {
+	stats   models.ForwardStats
+	expires time.Time
+}
+
+type memoryLock struct {
+	owner   string
+	expires time.Time
+}
+
+type memorySnapshot struct {
+	SavedAt     time.Time                         `json:"savedAt"`
+	Summaries   map[string]map[string]memoryEntry `json:"summaries"`
+	DeadLetters map[string]*models.DeadLetter     `json:"deadLetters"`
+}
+
+// NewMemory creates the embedded store and loads the snapshot file, if
+// there is one. With an empty file name nothing is persisted.
+func NewMemory(cfg *config.Config) (*Memory, error) {
+	m := &Memory{snapshotFile: cfg.SnapshotFile, done: make(chan struct{})}
+	m.reset()
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	m.wg.Add(1)
+	go m.run(cfg.SnapshotInterval)
+	return m, nil
+}
+
+func (m *Memory) reset() {
+	m.payments = make(map[string]*memoryPayment)
+	m.summaries = make(map[string]map[string]memoryEntry)
+	m.deadLetters = make(map[string]*models.DeadLetter)
+	m.health = make(map[string]string)
+	m.runTimes = make(map[string]time.Time)
+	m.breakers = make(map[string]*memoryBreaker)
+	m.forwards = make(map[forwardKey]*memoryForward)
+	m.locks = make(map[string]memoryLock)
+}
+
+// Close stops the snapshots and writes a last one.
+func (m *Memory) Close() error {
+	close(m.done)
+	m.wg.Wait()
+	return m.Snapshot()
+}
+
+// run expires idempotency records and writes a snapshot every interval.
+func (m *Memory) run(interval time.Duration) {
+	defer m.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.expire()
+			if err := m.Snapshot(); err != nil {
+				slog.Error("write snapshot failed", "file", m.snapshotFile, logging.Err(err))
+			}
+		}
+	}
+}
+
+func (m *Memory) expire() {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, p := range m.payments {
+		if !p.expires.IsZero() && now.After(p.expires) {
+			delete(m.payments, id)
+		}
+	}
+	for key, lock := range m.locks {
+		if now.After(lock.expires) {
+			delete(m.locks, key)
+		}
+	}
+	for key, f := range m.forwards {
+		if now.After(f.expires) {
+			delete(m.forwards, key)
+		}
+	}
+}
+
+// Snapshot writes summaries and dead letters to the snapshot file. The file
+// is replaced atomically, so a crash leaves the previous snapshot intact.
+func (m *Memory) Snapshot() error {
+	if m.snapshotFile == "" {
+		return nil
+	}
+	// Marshalling takes far longer than copying the maps, and would block
+	// every payment while holding the lock.
+	m.mu.Lock()
+	snapshot := memorySnapshot{
+		SavedAt:     time.Now().UTC(),
+		Summaries:   make(map[string]map[string]memoryEntry, len(m.summaries)),
+		DeadLetters: maps.Clone(m.deadLetters),
+	}
+	for table, entries := range m.summaries {
+		snapshot.Summaries[table] = maps.Clone(entries)
+	}
+	m.mu.Unlock()
+	data, err := oj.Marshal(&snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.snapshotFile), filepath.Base(m.snapshotFile)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return os.Rename(tmp.Name(), m.snapshotFile)
+}
+
+func (m *Memory) load() error {
+	if m.snapshotFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(m.snapshotFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	var snapshot memorySnapshot
+	if err := oj.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("failed to unmarshal snapshot %s: %w", m.snapshotFile, err)
+	}
+	if snapshot.Summaries != nil {
+		m.summaries = snapshot.Summaries
+	}
+	if snapshot.DeadLetters != nil {
+		m.deadLetters = snapshot.DeadLetters
+	}
+	slog.Info("snapshot loaded", "file", m.snapshotFile, "savedAt", snapshot.SavedAt)
+	return nil
+}
+
+func (m *Memory) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *Memory) Purge(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reset()
+	return nil
+}
+
+// payment returns the idempotency record of paymentID if it has not expired.
+func (m *Memory) payment(paymentID string, now time.Time) *memoryPayment {
+	p, ok := m.payments[paymentID]
+	if !ok || (!p.expires.IsZero() && now.After(p.expires)) {
+		return nil
+	}
+	return p
+}
+
+func (m *Memory) AcceptPayment(ctx context.Context, paymentID string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p := m.payment(paymentID, now); p != nil {
+		p.expires = now.Add(ttl)
+		return false, nil
+	}
+	m.payments[paymentID] = &memoryPayment{state: models.PAYMENT_STATE_ACCEPTED, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *Memory) BeginPayment(ctx context.Context, paymentID, owner string, lease, ttl time.Duration) (string, string, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.payment(paymentID, now)
+	if p == nil {
+		p = &memoryPayment{}
+		m.payments[paymentID] = p
+	}
+	if p.state == models.PAYMENT_STATE_DONE {
+		return models.PAYMENT_STATE_DONE, p.instance, nil
+	}
+	if now.Before(p.leaseUntil) {
+		return models.PAYMENT_STATE_BUSY, "", nil
+	}
+	p.leaseUntil = now.Add(lease)
+	p.state = models.PAYMENT_STATE_INFLIGHT
+	p.expires = now.Add(ttl)
+	return models.PAYMENT_STATE_INFLIGHT, p.instance, nil
+}
+
+func (m *Memory) PinPayment(ctx context.Context, paymentID, table string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p := m.payment(paymentID, time.Now()); p != nil {
+		p.instance = table
+	} else {
+		m.payments[paymentID] = &memoryPayment{instance: table}
+	}
+	return nil
+}
+
+func (m *Memory) CompletePayment(ctx context.Context, paymentID, table string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p := m.payment(paymentID, time.Now()); p != nil {
+		p.state = models.PAYMENT_STATE_DONE
+		p.instance = table
+		p.leaseUntil = time.Time{}
+	} else {
+		m.payments[paymentID] = &memoryPayment{state: models.PAYMENT_STATE_DONE, instance: table}
+	}
+	return nil
+}
+
+func (m *Memory) ReleasePayment(ctx context.Context, paymentID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p := m.payment(paymentID, time.Now()); p != nil {
+		p.leaseUntil = time.Time{}
+	}
+	return nil
+}
+
+func (m *Memory) SavePayment(ctx context.Context, instance *config.Service, payment *models.Payment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := m.summaries[instance.Table]
+	if entries == nil {
+		entries = make(map[string]memoryEntry)
+		m.summaries[instance.Table] = entries
+	}
+	entries[payment.PaymentID] = memoryEntry{Amount: payment.Amount, RequestedAt: payment.Timestamp}
+	return nil
+}
+
+func (m *Memory) GetSummary(ctx context.Context, instance *config.Service, summary *models.SummaryParam) (*models.ProcessorSummary, error) {
+	res := &models.ProcessorSummary{}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, entry := range m.summaries[instance.Table] {
+		if !summary.StartTime.IsZero() && entry.RequestedAt.Before(summary.StartTime) {
+			continue
+		}
+		if !summary.EndTime.IsZero() && entry.RequestedAt.After(summary.EndTime) {
+			continue
+		}
+		res.RequestCount++
+		res.TotalAmount = res.TotalAmount.Add(entry.Amount)
+	}
+	return res, nil
+}
+
+func (m *Memory) SaveDeadLetter(ctx context.Context, entry *models.DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deadLetters[entry.Payment.PaymentID] = entry
+	return nil
+}
+
+func (m *Memory) ListDeadLetters(ctx context.Context, offset, limit int64) ([]*models.DeadLetter, error) {
+	m.mu.Lock()
+	entries := make([]*models.DeadLetter, 0, len(m.deadLetters))
+	for _, entry := range m.deadLetters {
+		entries = append(entries, entry)
+	}
+	m.mu.Unlock()
+	slices.SortFunc(entries, func(a, b *models.DeadLetter) int {
+		return b.LastAttemptAt.Compare(a.LastAttemptAt)
+	})
+	if offset >= int64(len(entries)) {
+		return []*models.DeadLetter{}, nil
+	}
+	return entries[offset:min(offset+limit, int64(len(entries)))], nil
+}
+
+func (m *Memory) GetDeadLetter(ctx context.Context, paymentID string) (*models.DeadLetter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deadLetters[paymentID], nil
+}
+
+func (m *Memory) RemoveDeadLetter(ctx context.Context, paymentID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.deadLetters[paymentID]
+	delete(m.deadLetters, paymentID)
+	return ok, nil
+}
+
+func (m *Memory) SetHealth(ctx context.Context, field, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.health[field] = value
+	return nil
+}
+
+func (m *Memory) GetHealth(ctx context.Context, field string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.health[field], nil
+}
+
+func (m *Memory) GetLastRunTime(ctx context.Context, key string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.runTimes[key], nil
+}
+
+func (m *Memory) SetLastRunTime(ctx context.Context, key string, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runTimes[key] = t
+	return nil
+}
+
+// RecordBreaker follows recordBreakerScript.
+func (m *Memory) RecordBreaker(ctx context.Context, table string, success bool, threshold int, openTimeout time.Duration) (string, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := m.breakers[table]
+	if b == nil {
+		b = &memoryBreaker{state: "closed"}
+		m.breakers[table] = b
+	}
+	if success {
+		if b.state == "open" && now.Sub(b.openedAt) < openTimeout {
+			return "open", nil
+		}
+		b.state, b.failures = "closed", 0
+		return "closed", nil
+	}
+	b.failures++
+	if b.state == "closed" {
+		if b.failures < threshold {
+			return "closed", nil
+		}
+	} else if now.Sub(b.openedAt) < openTimeout {
+		return "open", nil
+	}
+	b.state, b.openedAt = "open", now
+	return "tripped", nil
+}
+
+func (m *Memory) GetBreaker(ctx context.Context, table string) (string, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b := m.breakers[table]; b != nil {
+		return b.state, b.openedAt, nil
+	}
+	return "closed", time.Time{}, nil
+}
+
+func (m *Memory) AddForwardStats(ctx context.Context, table string, bucket int64, stats models.ForwardStats, ttl time.Duration) error {
+	key := forwardKey{table: table, bucket: bucket}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.forwards[key]
+	if f == nil {
+		f = &memoryForward{}
+		m.forwards[key] = f
+	}
+	f.stats.Count += stats.Count
+	f.stats.Failures += stats.Failures
+	f.stats.Latency += stats.Latency
+	f.expires = time.Now().Add(ttl)
+	return nil
+}
+
+func (m *Memory) GetForwardStats(ctx context.Context, table string, buckets []int64) ([]models.ForwardStats, error) {
+	now := time.Now()
+	stats := make([]models.ForwardStats, len(buckets))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, bucket := range buckets {
+		if f := m.forwards[forwardKey{table: table, bucket: bucket}]; f != nil && now.Before(f.expires) {
+			stats[i] = f.stats
+		}
+	}
+	return stats, nil
+}
+
+func (m *Memory) TryLock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if lock, ok := m.locks[key]; ok && now.Before(lock.expires) {
+		return false, nil
+	}
+	m.locks[key] = memoryLock{owner: owner, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *Memory) Unlock(ctx context.Context, key, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if lock, ok := m.locks[key]; ok && lock.owner == owner {
+		delete(m.locks, key)
+	}
+	return nil
+}
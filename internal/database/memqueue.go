@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"rinha-2025-go/internal/models"
+	"sync"
+	"time"
+)
+
+// MemoryQueue is the in-process queue of the embedded mode. Payments are
+// lost if the process dies; there is nothing pending to acknowledge or
+// reclaim.
+type MemoryQueue struct {
+	mu      sync.Mutex
+	items   []*models.Payment
+	delayed []delayedPayment
+	ready   chan struct{} // Signalled when items is not empty
+}
+
+type delayedPayment struct {
+	due     time.Time
+	payment *models.Payment
+}
+
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{ready: make(chan struct{}, 1)}
+}
+
+// signal wakes up one Dequeue. It must be called with mu held.
+func (q *MemoryQueue) signal() {
+	if len(q.items) == 0 {
+		return
+	}
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue stores a copy of payment, as the caller may keep using it.
+func (q *MemoryQueue) Enqueue(ctx context.Context, payment *models.Payment) error {
+	p := *payment
+	p.QueueID = ""
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, &p)
+	q.signal()
+	return nil
+}
+
+func (q *MemoryQueue) EnqueueDelayed(ctx context.Context, payment *models.Payment, delay time.Duration) error {
+	if delay <= 0 {
+		return q.Enqueue(ctx, payment)
+	}
+	p := *payment
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.delayed = append(q.delayed, delayedPayment{due: time.Now().Add(delay), payment: &p})
+	return nil
+}
+
+func (q *MemoryQueue) PromoteDue(ctx context.Context, limit int) (int, error) {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	count := 0
+	pending := q.delayed[:0]
+	for _, d := range q.delayed {
+		if count < limit && !d.due.After(now) {
+			q.items = append(q.items, d.payment)
+			count++
+			continue
+		}
+		pending = append(pending, d)
+	}
+	clear(q.delayed[len(pending):])
+	q.delayed = pending
+	q.signal()
+	return count, nil
+}
+
+// Dequeue blocks for up to a second waiting for a payment.
+func (q *MemoryQueue) Dequeue(ctx context.Context) (*models.Payment, error) {
+	timeout := time.NewTimer(time.Second)
+	defer timeout.Stop()
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			payment := q.items[0]
+			q.items[0] = nil
+			q.items = q.items[1:]
+			q.signal()
+			q.mu.Unlock()
+			return payment, nil
+		}
+		q.mu.Unlock()
+		select {
+		case <-q.ready:
+		case <-timeout.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+}
+
+func (q *MemoryQueue) Ack(ctx context.Context, payment *models.Payment) error {
+	return nil
+}
+
+func (q *MemoryQueue) Requeue(ctx context.Context, payment *models.Payment) error {
+	return q.Enqueue(ctx, payment)
+}
+
+func (q *MemoryQueue) Reclaim(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (q *MemoryQueue) Length(ctx context.Context) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return int64(len(q.items))
+}
+
+func (q *MemoryQueue) Durable() bool {
+	return false
+}
+
+func (q *MemoryQueue) Close() error {
+	return nil
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"context"
+	"rinha-2025-go/pkg/metrics"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	redisDuration = metrics.NewHistogramVec("redis_command_duration_seconds",
+		"Latency of Redis commands, pipelines counted as one.", metrics.DefBuckets, "command")
+	redisErrors = metrics.NewCounterVec("redis_command_errors_total",
+		"Redis commands that failed, not counting empty replies.", "command")
+)
+
+// metricsHook records the latency and errors of every Redis command.
+type metricsHook struct{}
+
+func (metricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (metricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		observeRedis(cmd.Name(), start, err)
+		return err
+	}
+}
+
+func (metricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		observeRedis("pipeline", start, err)
+		return err
+	}
+}
+
+func observeRedis(command string, start time.Time, err error) {
+	redisDuration.With(command).Since(start)
+	if err != nil && err != redis.Nil {
+		redisErrors.With(command).Inc()
+	}
+}
+
+var (
+	ledgerFlushDuration = metrics.NewHistogram("ledger_flush_duration_seconds",
+		"Latency of the batched ledger inserts.", metrics.DefBuckets)
+	ledgerBatchSize = metrics.NewHistogram("ledger_batch_size",
+		"Payments written per ledger insert.", []float64{1, 5, 10, 25, 50, 100, 250, 500})
+	ledgerFlushErrors = metrics.NewCounter("ledger_flush_errors_total",
+		"Ledger inserts that failed.")
+)
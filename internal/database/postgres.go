@@ -0,0 +1,224 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"rinha-2025-go/internal/config"
+	"rinha-2025-go/internal/models"
+	"rinha-2025-go/pkg/logging"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	LEDGER_STATUS_PROCESSED = "processed"
+	LEDGER_WRITE_TIMEOUT    = 5 * time.Second
+)
+
+// ledgerSchema is applied on startup. The covering index lets summaries be
+// answered from the index alone for any time range of a processor.
+const ledgerSchema = `
+CREATE TABLE IF NOT EXISTS payments (
+	correlation_id TEXT PRIMARY KEY,
+	processor      TEXT NOT NULL,
+	amount         NUMERIC(14, 2) NOT NULL,
+	requested_at   TIMESTAMPTZ NOT NULL,
+	status         TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS payments_processor_requested_at
+	ON payments (processor, requested_at) INCLUDE (amount, status);
+`
+
+// insertLedgerBatch writes a whole batch in one statement. A correlationId
+// already in the ledger is left as is, so saving a payment twice is harmless.
+const insertLedgerBatch = `
+INSERT INTO payments (correlation_id, processor, amount, requested_at, status)
+SELECT id, processor, amount::numeric(14, 2), requested_at, $5
+FROM unnest($1::text[], $2::text[], $3::text[], $4::timestamptz[])
+	AS batch(id, processor, amount, requested_at)
+ON CONFLICT (correlation_id) DO NOTHING`
+
+var errLedgerClosed = errors.New("ledger is closed")
+
+// Postgres is the payment ledger, the system of record of the payments each
+// processor accepted. It only stores summaries; idempotency records, queues
+// and health state stay in the main store.
+//
+// SavePayment calls are grouped: a single goroutine collects them until
+// BatchSize payments are waiting or the oldest one has waited BatchInterval,
+// writes them with one INSERT and then answers every caller.
+type Postgres struct {
+	pool     *pgxpool.Pool
+	size     int
+	interval time.Duration
+	entries  chan *ledgerEntry
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+type ledgerEntry struct {
+	processor string
+	payment   models.Payment
+	result    chan error
+}
+
+// NewPostgres connects to the ledger database and creates its table if
+// needed.
+func NewPostgres(ctx context.Context, cfg *config.LedgerConfig) (*Postgres, error) {
+	poolCfg, err := pgxpool.ParseConfig(cfg.PostgresURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid postgres url: %w", err)
+	}
+	poolCfg.MaxConns = int32(cfg.PoolSize)
+	pool, err := pgxpool.NewWithConfig(ctx, poolCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	if _, err := pool.Exec(ctx, ledgerSchema); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to create ledger schema: %w", err)
+	}
+	p := &Postgres{
+		pool:     pool,
+		size:     cfg.BatchSize,
+		interval: cfg.BatchInterval,
+		entries:  make(chan *ledgerEntry, cfg.BatchSize),
+		done:     make(chan struct{}),
+	}
+	p.wg.Add(1)
+	go p.run()
+	return p, nil
+}
+
+// Close writes the payments still waiting for their batch and disconnects.
+func (p *Postgres) Close() error {
+	close(p.done)
+	p.wg.Wait()
+	p.pool.Close()
+	return nil
+}
+
+func (p *Postgres) Ping(ctx context.Context) error {
+	return p.pool.Ping(ctx)
+}
+
+func (p *Postgres) Purge(ctx context.Context) error {
+	_, err := p.pool.Exec(ctx, "TRUNCATE payments")
+	return err
+}
+
+// SavePayment returns once the batch holding the payment is written. When
+// ctx ends first the payment may still be written afterwards.
+func (p *Postgres) SavePayment(ctx context.Context, instance *config.Service, payment *models.Payment) error {
+	entry := &ledgerEntry{processor: instance.Table, payment: *payment, result: make(chan error, 1)}
+	select {
+	case p.entries <- entry:
+	case <-p.done:
+		return errLedgerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-entry.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Postgres) run() {
+	defer p.wg.Done()
+	batch := make([]*ledgerEntry, 0, p.size)
+	timer := time.NewTimer(p.interval)
+	timer.Stop()
+	for {
+		select {
+		case entry := <-p.entries:
+			batch = append(batch, entry)
+			if len(batch) == 1 {
+				timer.Reset(p.interval)
+			}
+			if len(batch) < p.size {
+				continue
+			}
+			timer.Stop()
+		case <-timer.C:
+		case <-p.done:
+			for {
+				select {
+				case entry := <-p.entries:
+					batch = append(batch, entry)
+				default:
+					p.flush(batch)
+					return
+				}
+			}
+		}
+		p.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+func (p *Postgres) flush(batch []*ledgerEntry) {
+	if len(batch) == 0 {
+		return
+	}
+	ids := make([]string, len(batch))
+	processors := make([]string, len(batch))
+	amounts := make([]string, len(batch))
+	requestedAt := make([]time.Time, len(batch))
+	for i, entry := range batch {
+		ids[i] = entry.payment.PaymentID
+		processors[i] = entry.processor
+		amounts[i] = entry.payment.Amount.String()
+		requestedAt[i] = entry.payment.Timestamp
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), LEDGER_WRITE_TIMEOUT)
+	defer cancel()
+	start := time.Now()
+	_, err := p.pool.Exec(ctx, insertLedgerBatch, ids, processors, amounts, requestedAt, LEDGER_STATUS_PROCESSED)
+	ledgerFlushDuration.Since(start)
+	ledgerBatchSize.Observe(float64(len(batch)))
+	if err != nil {
+		ledgerFlushErrors.Inc()
+		slog.Error("write ledger batch failed", "size", len(batch), logging.Err(err))
+		err = fmt.Errorf("failed to write ledger: %w", err)
+	}
+	for _, entry := range batch {
+		entry.result <- err
+	}
+}
+
+func (p *Postgres) GetSummary(ctx context.Context, instance *config.Service, summary *models.SummaryParam) (*models.ProcessorSummary, error) {
+	var query strings.Builder
+	query.WriteString(`SELECT count(*), (coalesce(sum(amount), 0) * 100)::int8 FROM payments
+WHERE processor = $1 AND status = $2`)
+	args := []any{instance.Table, LEDGER_STATUS_PROCESSED}
+	if !summary.StartTime.IsZero() {
+		args = append(args, summary.StartTime)
+		query.WriteString(" AND requested_at >= $" + strconv.Itoa(len(args)))
+	}
+	if !summary.EndTime.IsZero() {
+		args = append(args, summary.EndTime)
+		query.WriteString(" AND requested_at <= $" + strconv.Itoa(len(args)))
+	}
+	var cents int64
+	res := &models.ProcessorSummary{}
+	err := p.pool.QueryRow(ctx, query.String(), args...).Scan(&res.RequestCount, &cents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ledger summary: %w", err)
+	}
+	res.TotalAmount = models.MinorUnits(cents)
+	return res, nil
+}
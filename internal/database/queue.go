@@ -0,0 +1,334 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"rinha-2025-go/internal/config"
+	"rinha-2025-go/internal/models"
+	"rinha-2025-go/pkg/logging"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ohler55/ojg/oj"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	QUEUE_MODE_LIST   = "list"
+	QUEUE_MODE_STREAM = "stream"
+
+	QUEUE_LIST_KEY     = "payment-queue"
+	QUEUE_STREAM_KEY   = "payment-stream"
+	QUEUE_STREAM_GROUP = "payment-workers"
+	QUEUE_STREAM_FIELD = "p"
+	QUEUE_DELAYED_KEY  = "payment-delayed"
+)
+
+// promoteDueScript moves payments whose retry time has come from the delay
+// set to the queue. It runs atomically, so concurrent instances never
+// promote the same entry twice.
+var promoteDueScript = redis.NewScript(`
+local items = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, item in ipairs(items) do
+	redis.call('ZREM', KEYS[1], item)
+	if ARGV[3] == 'stream' then
+		redis.call('XADD', KEYS[2], '*', ARGV[4], item)
+	else
+		redis.call('RPUSH', KEYS[2], item)
+	end
+end
+return #items
+`)
+
+// bufferPool holds the buffers payments are marshaled into before queueing.
+var bufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
+}
+
+// RedisQueue is the Redis backed overflow queue shared by all instances.
+//
+// In list mode payments are popped with BLPOP and lost if the instance dies
+// before forwarding them. In stream mode payments are read through a consumer
+// group and stay pending until acknowledged; entries left pending longer than
+// the visibility timeout are re-queued by Reclaim.
+type RedisQueue struct {
+	key        string // Redis key for the queue (list or stream)
+	mode       string
+	group      string
+	consumer   string
+	visibility time.Duration
+	client     *redis.Client
+}
+
+func NewRedisQueue(ctx context.Context, cfg *config.Config, redis *Redis) *RedisQueue {
+	consumer, _ := os.Hostname()
+	q := &RedisQueue{
+		key:        QUEUE_LIST_KEY,
+		mode:       cfg.QueueMode,
+		group:      QUEUE_STREAM_GROUP,
+		consumer:   consumer,
+		visibility: cfg.QueueVisibilityTimeout,
+		client:     redis.Rdb,
+	}
+	if q.mode == QUEUE_MODE_STREAM {
+		q.key = QUEUE_STREAM_KEY
+		if err := q.createGroup(ctx); err != nil {
+			slog.Error("create consumer group failed", "stream", q.key, logging.Err(err))
+		}
+	}
+	return q
+}
+
+func (q *RedisQueue) createGroup(ctx context.Context) error {
+	err := q.client.XGroupCreateMkStream(ctx, q.key, q.group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create consumer group: %w", err)
+	}
+	return nil
+}
+
+func (q *RedisQueue) Enqueue(ctx context.Context, payment *models.Payment) error {
+	bufPtr := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bufPtr)
+
+	data, err := oj.Marshal(payment, *bufPtr)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	if q.mode == QUEUE_MODE_STREAM {
+		err = q.client.XAdd(ctx, &redis.XAddArgs{
+			Stream: q.key,
+			Values: []any{QUEUE_STREAM_FIELD, data},
+		}).Err()
+	} else {
+		err = q.client.RPush(ctx, q.key, data).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to push to queue: %w", err)
+	}
+	return nil
+}
+
+// EnqueueDelayed schedules a payment to be queued again after delay.
+func (q *RedisQueue) EnqueueDelayed(ctx context.Context, payment *models.Payment, delay time.Duration) error {
+	if delay <= 0 {
+		return q.Enqueue(ctx, payment)
+	}
+	bufPtr := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bufPtr)
+
+	data, err := oj.Marshal(payment, *bufPtr)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	due := time.Now().Add(delay).UnixMilli()
+	err = q.client.ZAdd(ctx, QUEUE_DELAYED_KEY, redis.Z{Score: float64(due), Member: data}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to schedule retry: %w", err)
+	}
+	return nil
+}
+
+// PromoteDue moves up to limit delayed payments that are due into the queue
+// and returns how many were moved.
+func (q *RedisQueue) PromoteDue(ctx context.Context, limit int) (int, error) {
+	keys := []string{QUEUE_DELAYED_KEY, q.key}
+	count, err := promoteDueScript.Run(ctx, q.client, keys,
+		time.Now().UnixMilli(), limit, q.mode, QUEUE_STREAM_FIELD).Int()
+	if err != nil {
+		return 0, fmt.Errorf("failed to promote delayed payments: %w", err)
+	}
+	return count, nil
+}
+
+// Dequeue blocks for up to a second waiting for a payment. It returns a nil
+// payment and a nil error when the queue stayed empty.
+func (q *RedisQueue) Dequeue(ctx context.Context) (*models.Payment, error) {
+	if q.mode == QUEUE_MODE_STREAM {
+		return q.dequeueStream(ctx)
+	}
+	result, err := q.client.BLPop(ctx, 1*time.Second, q.key).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to pop from queue: %w", err)
+	}
+	var payment models.Payment
+	err = oj.Unmarshal([]byte(result[1]), &payment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+	return &payment, nil
+}
+
+func (q *RedisQueue) dequeueStream(ctx context.Context) (*models.Payment, error) {
+	streams, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    q.group,
+		Consumer: q.consumer,
+		Streams:  []string{q.key, ">"},
+		Count:    1,
+		Block:    time.Second,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		// The group is gone after a FLUSHDB (purge-payments); recreate it.
+		if strings.HasPrefix(err.Error(), "NOGROUP") {
+			return nil, q.createGroup(ctx)
+		}
+		return nil, fmt.Errorf("failed to read from stream: %w", err)
+	}
+	if len(streams) == 0 || len(streams[0].Messages) == 0 {
+		return nil, nil
+	}
+	msg := streams[0].Messages[0]
+	payment, err := q.decodeMessage(msg)
+	if err != nil {
+		q.ackID(ctx, msg.ID)
+		return nil, err
+	}
+	return payment, nil
+}
+
+func (q *RedisQueue) decodeMessage(msg redis.XMessage) (*models.Payment, error) {
+	data, ok := msg.Values[QUEUE_STREAM_FIELD].(string)
+	if !ok {
+		return nil, fmt.Errorf("malformed stream entry %s", msg.ID)
+	}
+	var payment models.Payment
+	if err := oj.Unmarshal([]byte(data), &payment); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+	payment.QueueID = msg.ID
+	return &payment, nil
+}
+
+// Ack marks a payment read from the stream as done. Payments that did not
+// come from the stream, and every payment in list mode, are ignored.
+func (q *RedisQueue) Ack(ctx context.Context, payment *models.Payment) error {
+	if q.mode != QUEUE_MODE_STREAM || payment.QueueID == "" {
+		return nil
+	}
+	return q.ackID(ctx, payment.QueueID)
+}
+
+func (q *RedisQueue) ackID(ctx context.Context, id string) error {
+	pipe := q.client.TxPipeline()
+	pipe.XAck(ctx, q.key, q.group, id)
+	pipe.XDel(ctx, q.key, id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to ack %s: %w", id, err)
+	}
+	return nil
+}
+
+// Requeue puts a payment that was taken from the queue, but not processed,
+// back at its tail. In stream mode the original entry is acknowledged in the
+// same transaction.
+func (q *RedisQueue) Requeue(ctx context.Context, payment *models.Payment) error {
+	if q.mode != QUEUE_MODE_STREAM || payment.QueueID == "" {
+		return q.Enqueue(ctx, payment)
+	}
+	bufPtr := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bufPtr)
+
+	data, err := oj.Marshal(payment, *bufPtr)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	pipe := q.client.TxPipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: q.key,
+		Values: []any{QUEUE_STREAM_FIELD, data},
+	})
+	pipe.XAck(ctx, q.key, q.group, payment.QueueID)
+	pipe.XDel(ctx, q.key, payment.QueueID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to requeue %s: %w", payment.QueueID, err)
+	}
+	return nil
+}
+
+// Reclaim re-queues stream entries that have been pending for longer than
+// the visibility timeout, which happens when the consumer holding them
+// crashed. It returns the number of payments re-queued.
+func (q *RedisQueue) Reclaim(ctx context.Context) (int, error) {
+	if q.mode != QUEUE_MODE_STREAM {
+		return 0, nil
+	}
+	count := 0
+	start := "0-0"
+	for {
+		msgs, next, err := q.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   q.key,
+			Group:    q.group,
+			Consumer: q.consumer,
+			MinIdle:  q.visibility,
+			Start:    start,
+			Count:    100,
+		}).Result()
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				return count, q.createGroup(ctx)
+			}
+			return count, fmt.Errorf("failed to claim pending entries: %w", err)
+		}
+		for _, msg := range msgs {
+			data, ok := msg.Values[QUEUE_STREAM_FIELD]
+			pipe := q.client.TxPipeline()
+			if ok {
+				pipe.XAdd(ctx, &redis.XAddArgs{
+					Stream: q.key,
+					Values: []any{QUEUE_STREAM_FIELD, data},
+				})
+			}
+			pipe.XAck(ctx, q.key, q.group, msg.ID)
+			pipe.XDel(ctx, q.key, msg.ID)
+			if _, err := pipe.Exec(ctx); err != nil {
+				return count, fmt.Errorf("failed to requeue %s: %w", msg.ID, err)
+			}
+			if ok {
+				count++
+			}
+		}
+		if next == "0-0" || next == "" {
+			return count, nil
+		}
+		start = next
+	}
+}
+
+// Length returns the number of queued payments. In stream mode this includes
+// entries that were delivered but not acknowledged yet.
+func (q *RedisQueue) Length(ctx context.Context) int64 {
+	var length int64
+	var err error
+	if q.mode == QUEUE_MODE_STREAM {
+		length, err = q.client.XLen(ctx, q.key).Result()
+	} else {
+		length, err = q.client.LLen(ctx, q.key).Result()
+	}
+	if err != nil {
+		return 0
+	}
+	return length
+}
+
+// Durable is only true for streams: a payment popped from a list lives in
+// the memory of its consumer until it is processed.
+func (q *RedisQueue) Durable() bool {
+	return q.mode == QUEUE_MODE_STREAM
+}
+
+func (q *RedisQueue) Close() error {
+	// The client is shared with Redis and closed with it.
+	return nil
+}
@@ -6,99 +6,602 @@ package database
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"rinha-2025-go/internal/config"
 	"rinha-2025-go/internal/models"
+	"rinha-2025-go/pkg/logging"
 	"strconv"
 	"time"
 
+	"github.com/ohler55/ojg/oj"
 	"github.com/redis/go-redis/v9"
 )
 
 type Redis struct {
-	ctx context.Context
 	Rdb *redis.Client
 }
 
-func NewRedisClient(cfg *config.Config) *Redis {
-	ctx := context.Background()
+// NewRedisClient connects to Redis. Every method takes the context of the
+// operation; its deadline also bounds the socket reads and writes.
+func NewRedisClient(ctx context.Context, cfg *config.Config) (*Redis, error) {
 	rdb := redis.NewClient(&redis.Options{
-		Addr:         cfg.RedisSocket,
-		PoolSize:     200,
-		ReadTimeout:  cfg.RedisReadTimeout,
-		WriteTimeout: cfg.RedisWriteTimeout,
-		PoolTimeout:  cfg.RedisPoolTimeout,
+		Addr:                  cfg.RedisSocket,
+		PoolSize:              cfg.RedisPoolSize,
+		ReadTimeout:           cfg.RedisReadTimeout,
+		WriteTimeout:          cfg.RedisWriteTimeout,
+		PoolTimeout:           cfg.RedisPoolTimeout,
+		ContextTimeoutEnabled: true,
 	})
+	rdb.AddHook(metricsHook{})
 	if _, err := rdb.Ping(ctx).Result(); err != nil {
-		log.Fatalf("failed to connect to redis: %v", err)
+		rdb.Close()
+		return nil, fmt.Errorf("failed to connect to redis at %s: %w", cfg.RedisSocket, err)
 	}
 	return &Redis{
-		ctx: ctx,
 		Rdb: rdb,
+	}, nil
+}
+
+func (r *Redis) Close() error {
+	return r.Rdb.Close()
+}
+
+// Summaries are pre-aggregated at write time: besides the raw amount and
+// score of each payment, savePaymentScript adds it to a per-second and a
+// per-minute bucket holding the count ("n:<bucket>") and the amount in cents
+// ("c:<bucket>"). A payment that was already saved is left as is, so it is
+// never counted twice.
+var savePaymentScript = redis.NewScript(`
+if redis.call('HSETNX', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+-- Until the buckets are rebuilt, payments past the migration cursor are left
+-- for the migration to count.
+local migration = redis.call('HMGET', KEYS[6], ARGV[7], ARGV[7] .. ':cursor')
+if not migration[1] and not (migration[2] and tonumber(ARGV[3]) <= tonumber(migration[2])) then
+	return 1
+end
+redis.call('HINCRBY', KEYS[3], 'n:' .. ARGV[4], 1)
+redis.call('HINCRBY', KEYS[3], 'c:' .. ARGV[4], ARGV[6])
+redis.call('HINCRBY', KEYS[4], 'n:' .. ARGV[5], 1)
+redis.call('HINCRBY', KEYS[4], 'c:' .. ARGV[5], ARGV[6])
+redis.call('ZADD', KEYS[5], ARGV[5], ARGV[5])
+return 1
+`)
+
+// luaToCents is the Lua helper reading a stored amount. Amounts are written
+// as decimals with two places; older records hold the shortest form of a
+// float64 and are rounded to the cent.
+const luaToCents = `
+local function toCents(v)
+	local units, frac = string.match(v, '^(-?%d+)%.(%d%d)$')
+	if units then
+		return tonumber(units .. frac)
+	end
+	return math.floor(tonumber(v) * 100 + 0.5)
+end
+`
+
+// MIGRATIONS_KEY is the hash recording the data migrations already run.
+const MIGRATIONS_KEY = "migrations"
+
+// SUMMARY_MIGRATION_BATCH is the number of payments a call of
+// rebuildBucketsScript reads, so Redis is never blocked for long.
+const SUMMARY_MIGRATION_BATCH = 1000
+
+// rebuildBucketsScript fills the summary buckets of a processor from its raw
+// payments, for those saved before the buckets existed, a batch per call.
+// ARGV[1] names the migration in MIGRATIONS_KEY: once done it is set to 1,
+// until then its ":cursor" field holds the score up to which payments were
+// counted. A batch ends at the score of the ARGV[2]th payment past the
+// cursor, ties included, so none is split between two calls. SavePayment
+// only adds the payments up to the cursor to the buckets, so those saved
+// meanwhile are neither missed nor counted twice. It returns the number of
+// payments read and whether the buckets are complete, or -1 when they
+// already were.
+var rebuildBucketsScript = redis.NewScript(luaToCents + `
+local state = redis.call('HMGET', KEYS[6], ARGV[1], ARGV[1] .. ':cursor')
+if state[1] then
+	return {-1, 1}
+end
+local min = '-inf'
+if state[2] then
+	min = '(' .. state[2]
+else
+	redis.call('DEL', KEYS[3], KEYS[4], KEYS[5])
+end
+local max = '+inf'
+local last = redis.call('ZRANGEBYSCORE', KEYS[2], min, '+inf', 'WITHSCORES', 'LIMIT', tonumber(ARGV[2]) - 1, 1)
+if #last > 0 then
+	max = last[2]
+end
+local page = redis.call('ZRANGEBYSCORE', KEYS[2], min, max, 'WITHSCORES')
+local count = 0
+for i = 1, #page, 2000 do
+	local ids = {}
+	for j = i, math.min(i + 1999, #page), 2 do
+		ids[#ids + 1] = page[j]
+	end
+	local values = redis.call('HMGET', KEYS[1], unpack(ids))
+	for j = 1, #ids do
+		local amount = values[j]
+		if amount then
+			local second = math.floor(tonumber(page[i + 2 * j - 1]))
+			local minute = math.floor(second / 60)
+			local s, m = string.format('%d', second), string.format('%d', minute)
+			local cents = string.format('%d', toCents(amount))
+			redis.call('HINCRBY', KEYS[3], 'n:' .. s, 1)
+			redis.call('HINCRBY', KEYS[3], 'c:' .. s, cents)
+			redis.call('HINCRBY', KEYS[4], 'n:' .. m, 1)
+			redis.call('HINCRBY', KEYS[4], 'c:' .. m, cents)
+			redis.call('ZADD', KEYS[5], m, m)
+			count = count + 1
+		end
+	end
+end
+if max == '+inf' then
+	redis.call('HSET', KEYS[6], ARGV[1], 1)
+	redis.call('HDEL', KEYS[6], ARGV[1] .. ':cursor')
+	return {count, 1}
+end
+redis.call('HSET', KEYS[6], ARGV[1] .. ':cursor', max)
+return {count, 0}
+`)
+
+// MigrateSummaries rebuilds the summary buckets of processors whose
+// payments were saved before buckets existed; see rebuildBucketsScript. An
+// interrupted migration resumes from its cursor.
+func (r *Redis) MigrateSummaries(ctx context.Context, processors []*config.Service) error {
+	for _, instance := range processors {
+		var total int64
+		for {
+			res, err := rebuildBucketsScript.Run(ctx, r.Rdb, migrationKeys(instance),
+				bucketsMigration(instance), SUMMARY_MIGRATION_BATCH).Int64Slice()
+			if err != nil {
+				return fmt.Errorf("failed to rebuild %s summary buckets: %w", instance.Name, err)
+			}
+			if res[0] < 0 {
+				break
+			}
+			total += res[0]
+			if res[1] == 1 {
+				slog.Info("summary buckets rebuilt", logging.KeyProcessor, instance.Name, "payments", total)
+				break
+			}
+		}
 	}
+	return nil
+}
+
+// bucketsMigration is the field of MIGRATIONS_KEY recording the rebuild of
+// the summary buckets of instance.
+func bucketsMigration(instance *config.Service) string {
+	return "summary-buckets:" + instance.Table
+}
+
+// migrationKeys are summaryKeys followed by MIGRATIONS_KEY, for the scripts
+// that depend on the state of the bucket migration.
+func migrationKeys(instance *config.Service) []string {
+	return append(summaryKeys(instance), MIGRATIONS_KEY)
 }
 
-func (r *Redis) Close() {
-	r.Rdb.Close()
+func summaryKeys(instance *config.Service) []string {
+	return []string{instance.KeyAmount, instance.KeyTime, instance.KeySeconds, instance.KeyMinutes, instance.KeyMinuteIndex}
 }
 
-func (r *Redis) SavePayment(instance *config.Service, payment *models.Payment) error {
+func (r *Redis) SavePayment(ctx context.Context, instance *config.Service, payment *models.Payment) error {
 	ts := float64(payment.Timestamp.UnixNano()) / 1e9
-	pipe := r.Rdb.Pipeline()
-	pipe.HSet(r.ctx, instance.KeyAmount, payment.PaymentID, payment.Amount)
-	pipe.ZAdd(r.ctx, instance.KeyTime, redis.Z{Score: ts, Member: payment.PaymentID})
-	_, err := pipe.Exec(r.ctx)
+	// Buckets are derived from the score, so that the raw edges read by
+	// GetSummary agree with them.
+	second := int64(math.Floor(ts))
+	minute := int64(math.Floor(float64(second) / 60))
+	return savePaymentScript.Run(ctx, r.Rdb, migrationKeys(instance),
+		payment.PaymentID, payment.Amount.String(), strconv.FormatFloat(ts, 'f', -1, 64),
+		second, minute, payment.Amount.MinorUnits(), bucketsMigration(instance)).Err()
+}
+
+func (r *Redis) RemovePayment(ctx context.Context, instance *config.Service, payment *models.Payment) error {
+	return r.Rdb.HDel(ctx, instance.KeyTime, payment.PaymentID).Err()
+}
+
+// Idempotency records are kept per correlationId in a hash holding the
+// pipeline state and, after an attempt with an unknown outcome, the table of
+// the processor that may already have charged it. A separate lease key makes
+// sure a single worker forwards a given payment at a time.
+var beginPaymentScript = redis.NewScript(`
+local state = redis.call('HGET', KEYS[1], 'state')
+if state == 'done' then
+	return {'done', redis.call('HGET', KEYS[1], 'instance') or ''}
+end
+if not redis.call('SET', KEYS[2], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return {'busy', ''}
+end
+redis.call('HSET', KEYS[1], 'state', 'inflight')
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+return {'inflight', redis.call('HGET', KEYS[1], 'instance') or ''}
+`)
+
+func paymentKey(paymentID string) string {
+	return "idem:" + paymentID
+}
+
+func paymentLeaseKey(paymentID string) string {
+	return "idem:" + paymentID + ":lease"
+}
+
+// AcceptPayment records a new correlationId and reports false if it was
+// already known.
+func (r *Redis) AcceptPayment(ctx context.Context, paymentID string, ttl time.Duration) (bool, error) {
+	key := paymentKey(paymentID)
+	pipe := r.Rdb.TxPipeline()
+	accepted := pipe.HSetNX(ctx, key, "state", models.PAYMENT_STATE_ACCEPTED)
+	pipe.Expire(ctx, key, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return accepted.Val(), nil
+}
+
+// BeginPayment takes the forwarding lease for a payment. It returns the
+// resulting state (inflight, busy or done) and the table of the processor a
+// previous ambiguous attempt was sent to, if any.
+func (r *Redis) BeginPayment(ctx context.Context, paymentID, owner string, lease, ttl time.Duration) (string, string, error) {
+	keys := []string{paymentKey(paymentID), paymentLeaseKey(paymentID)}
+	res, err := beginPaymentScript.Run(ctx, r.Rdb, keys,
+		owner, lease.Milliseconds(), int64(ttl.Seconds())).StringSlice()
+	if err != nil {
+		return "", "", err
+	}
+	return res[0], res[1], nil
+}
+
+// PinPayment remembers the processor a payment may already have reached, so
+// retries go to the same processor instead of charging twice.
+func (r *Redis) PinPayment(ctx context.Context, paymentID, table string) error {
+	return r.Rdb.HSet(ctx, paymentKey(paymentID), "instance", table).Err()
+}
+
+func (r *Redis) CompletePayment(ctx context.Context, paymentID, table string) error {
+	pipe := r.Rdb.TxPipeline()
+	pipe.HSet(ctx, paymentKey(paymentID), "state", models.PAYMENT_STATE_DONE, "instance", table)
+	pipe.Del(ctx, paymentLeaseKey(paymentID))
+	_, err := pipe.Exec(ctx)
 	return err
 }
 
-func (r *Redis) RemovePayment(instance *config.Service, payment *models.Payment) error {
-	return r.Rdb.HDel(r.ctx, instance.KeyTime, payment.PaymentID).Err()
+func (r *Redis) ReleasePayment(ctx context.Context, paymentID string) error {
+	return r.Rdb.Del(ctx, paymentLeaseKey(paymentID)).Err()
 }
 
-func (r *Redis) GetSummary(instance *config.Service, summary *models.SummaryParam) *models.ProcessorSummary {
-	res := &models.ProcessorSummary{}
-	ids, err := r.Rdb.ZRangeByScore(r.ctx, instance.KeyTime,
-		&redis.ZRangeBy{Min: summary.StartTime, Max: summary.EndTime}).Result()
-	if err != nil || len(ids) == 0 {
-		if err != nil {
-			log.Println("GetSummary:ZRangeByScore:", instance.Table, ":", err)
+// recordBreakerScript folds one call outcome into a shared circuit breaker.
+// The stored state is either closed or open; an open breaker whose timeout
+// has elapsed is half-open and the next outcome closes or re-opens it.
+var recordBreakerScript = redis.NewScript(`
+local state = redis.call('HGET', KEYS[1], 'state') or 'closed'
+local now = tonumber(ARGV[3])
+if ARGV[1] == '1' then
+	if state == 'open' and now - tonumber(redis.call('HGET', KEYS[1], 'openedAt') or 0) < tonumber(ARGV[4]) then
+		return 'open'
+	end
+	redis.call('HSET', KEYS[1], 'state', 'closed', 'failures', 0)
+	return 'closed'
+end
+local failures = redis.call('HINCRBY', KEYS[1], 'failures', 1)
+if state == 'closed' then
+	if failures < tonumber(ARGV[2]) then
+		return 'closed'
+	end
+elseif now - tonumber(redis.call('HGET', KEYS[1], 'openedAt') or 0) < tonumber(ARGV[4]) then
+	return 'open'
+end
+redis.call('HSET', KEYS[1], 'state', 'open', 'openedAt', now)
+return 'tripped'
+`)
+
+func breakerKey(table string) string {
+	return "breaker:" + table
+}
+
+// RecordBreaker updates the breaker of a processor and returns closed, open
+// or tripped when this outcome opened it.
+func (r *Redis) RecordBreaker(ctx context.Context, table string, success bool, threshold int, openTimeout time.Duration) (string, error) {
+	ok := "0"
+	if success {
+		ok = "1"
+	}
+	return recordBreakerScript.Run(ctx, r.Rdb, []string{breakerKey(table)},
+		ok, threshold, time.Now().UnixMilli(), openTimeout.Milliseconds()).Text()
+}
+
+// GetBreaker returns the stored breaker state and when it was last opened.
+func (r *Redis) GetBreaker(ctx context.Context, table string) (string, time.Time, error) {
+	values, err := r.Rdb.HMGet(ctx, breakerKey(table), "state", "openedAt").Result()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	state, _ := values[0].(string)
+	if state == "" {
+		state = "closed"
+	}
+	var openedAt time.Time
+	if s, ok := values[1].(string); ok {
+		if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+			openedAt = time.UnixMilli(ms)
+		}
+	}
+	return state, openedAt, nil
+}
+
+func forwardStatsKey(table string, bucket int64) string {
+	return "forward:" + table + ":" + strconv.FormatInt(bucket, 10)
+}
+
+// AddForwardStats adds to the hash of a statistics bucket: the forward count,
+// the failures and the total latency in microseconds.
+func (r *Redis) AddForwardStats(ctx context.Context, table string, bucket int64, stats models.ForwardStats, ttl time.Duration) error {
+	key := forwardStatsKey(table, bucket)
+	pipe := r.Rdb.TxPipeline()
+	pipe.HIncrBy(ctx, key, "n", stats.Count)
+	pipe.HIncrBy(ctx, key, "f", stats.Failures)
+	pipe.HIncrBy(ctx, key, "l", stats.Latency.Microseconds())
+	pipe.Expire(ctx, key, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to add forward stats: %w", err)
+	}
+	return nil
+}
+
+func (r *Redis) GetForwardStats(ctx context.Context, table string, buckets []int64) ([]models.ForwardStats, error) {
+	pipe := r.Rdb.Pipeline()
+	cmds := make([]*redis.SliceCmd, len(buckets))
+	for i, bucket := range buckets {
+		cmds[i] = pipe.HMGet(ctx, forwardStatsKey(table, bucket), "n", "f", "l")
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get forward stats: %w", err)
+	}
+	stats := make([]models.ForwardStats, len(buckets))
+	for i, cmd := range cmds {
+		var fields [3]int64
+		for j, v := range cmd.Val() {
+			if s, ok := v.(string); ok {
+				fields[j], _ = strconv.ParseInt(s, 10, 64)
+			}
+		}
+		stats[i] = models.ForwardStats{
+			Count:    fields[0],
+			Failures: fields[1],
+			Latency:  time.Duration(fields[2]) * time.Microsecond,
 		}
-		return res
 	}
+	return stats, nil
+}
+
+const (
+	DEAD_LETTER_KEY   = "dlq"
+	DEAD_LETTER_INDEX = "dlq:index"
+)
 
-	res.RequestCount = len(ids)
-	amounts, err := r.Rdb.HMGet(r.ctx, instance.KeyAmount, ids...).Result()
+func (r *Redis) SaveDeadLetter(ctx context.Context, entry *models.DeadLetter) error {
+	data, err := oj.Marshal(entry)
 	if err != nil {
-		log.Println("GetSummary:HMGet:", instance.Table, ":", err)
-		return res
+		return fmt.Errorf("failed to marshal dead letter: %w", err)
 	}
+	id := entry.Payment.PaymentID
+	ts := float64(entry.LastAttemptAt.UnixNano()) / 1e9
+	pipe := r.Rdb.TxPipeline()
+	pipe.HSet(ctx, DEAD_LETTER_KEY, id, data)
+	pipe.ZAdd(ctx, DEAD_LETTER_INDEX, redis.Z{Score: ts, Member: id})
+	_, err = pipe.Exec(ctx)
+	return err
+}
 
-	for _, val := range amounts {
-		if val == nil {
+// ListDeadLetters returns dead letters newest first.
+func (r *Redis) ListDeadLetters(ctx context.Context, offset, limit int64) ([]*models.DeadLetter, error) {
+	res := []*models.DeadLetter{}
+	ids, err := r.Rdb.ZRevRange(ctx, DEAD_LETTER_INDEX, offset, offset+limit-1).Result()
+	if err != nil || len(ids) == 0 {
+		return res, err
+	}
+	values, err := r.Rdb.HMGet(ctx, DEAD_LETTER_KEY, ids...).Result()
+	if err != nil {
+		return res, err
+	}
+	for _, val := range values {
+		s, ok := val.(string)
+		if !ok {
 			continue
 		}
-		if s, ok := val.(string); ok {
-			if i, err := strconv.ParseFloat(s, 64); err == nil {
-				res.TotalAmount += i
-			}
+		var entry models.DeadLetter
+		if err := oj.Unmarshal([]byte(s), &entry); err != nil {
+			slog.Error("decode dead letter failed", logging.Err(err))
+			continue
 		}
+		res = append(res, &entry)
 	}
-	return res
+	return res, nil
 }
 
-func (r *Redis) FlushAll() error {
-	ctx := context.Background()
-	r.Rdb.FlushDB(ctx)
-	return nil
+// GetDeadLetter returns nil without error when the id is unknown.
+func (r *Redis) GetDeadLetter(ctx context.Context, paymentID string) (*models.DeadLetter, error) {
+	data, err := r.Rdb.HGet(ctx, DEAD_LETTER_KEY, paymentID).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry models.DeadLetter
+	if err := oj.Unmarshal([]byte(data), &entry); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dead letter: %w", err)
+	}
+	return &entry, nil
 }
 
-func (r *Redis) SetString(key, label, value string) error {
-	ctx := context.Background()
+// RemoveDeadLetter reports whether the entry existed.
+func (r *Redis) RemoveDeadLetter(ctx context.Context, paymentID string) (bool, error) {
+	pipe := r.Rdb.TxPipeline()
+	removed := pipe.HDel(ctx, DEAD_LETTER_KEY, paymentID)
+	pipe.ZRem(ctx, DEAD_LETTER_INDEX, paymentID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return removed.Val() > 0, nil
+}
+
+// summaryScript sums a window of one processor's payments. Whole minutes
+// and whole seconds are read from their buckets; only the payments in the
+// partial seconds at the edges of the window are read one by one.
+//
+// ARGV holds two raw score ranges, two second ranges and a minute range, in
+// that order, as min/max pairs; a range whose min is "" is skipped. Minute
+// bounds may be -inf/+inf. They are followed by the whole window, read one
+// by one while the buckets are still being rebuilt, and the name of that
+// migration.
+var summaryScript = redis.NewScript(luaToCents + `
+local count, cents = 0, 0
+local function amounts(ids)
+	for i = 1, #ids, 1000 do
+		local values = redis.call('HMGET', KEYS[1], unpack(ids, i, math.min(i + 999, #ids)))
+		for _, v in ipairs(values) do
+			if v then
+				count = count + 1
+				cents = cents + toCents(v)
+			end
+		end
+	end
+end
+local function buckets(key, names)
+	for i = 1, #names, 500 do
+		local fields = {}
+		for j = i, math.min(i + 499, #names) do
+			fields[#fields + 1] = 'n:' .. names[j]
+			fields[#fields + 1] = 'c:' .. names[j]
+		end
+		local values = redis.call('HMGET', key, unpack(fields))
+		for j = 1, #values, 2 do
+			count = count + (tonumber(values[j]) or 0)
+			cents = cents + (tonumber(values[j + 1]) or 0)
+		end
+	end
+end
+if not redis.call('HGET', KEYS[6], ARGV[13]) then
+	amounts(redis.call('ZRANGEBYSCORE', KEYS[2], ARGV[11], ARGV[12]))
+	return {count, cents}
+end
+for i = 1, 3, 2 do
+	if ARGV[i] ~= '' then
+		amounts(redis.call('ZRANGEBYSCORE', KEYS[2], ARGV[i], ARGV[i + 1]))
+	end
+end
+for i = 5, 7, 2 do
+	if ARGV[i] ~= '' then
+		local names = {}
+		for b = tonumber(ARGV[i]), tonumber(ARGV[i + 1]) do
+			names[#names + 1] = string.format('%d', b)
+		end
+		buckets(KEYS[3], names)
+	end
+end
+if ARGV[9] ~= '' then
+	buckets(KEYS[4], redis.call('ZRANGEBYSCORE', KEYS[5], ARGV[9], ARGV[10]))
+end
+return {count, cents}
+`)
+
+// summaryWindow splits the [from, to] score window into the script
+// arguments of summaryScript. A second is whole when every score it can hold
+// is in the window, and a minute when all its seconds are.
+func summaryWindow(from, to float64) []any {
+	args := []any{"", "", "", "", "", "", "", "", "", ""}
+	firstSecond, lastSecond := math.Ceil(from), math.Floor(to)-1
+	if firstSecond > lastSecond {
+		args[0], args[1] = formatScore(from), formatScore(to)
+		return args
+	}
+	if from < firstSecond {
+		args[0], args[1] = formatScore(from), "("+formatScore(firstSecond)
+	}
+	if !math.IsInf(to, 1) {
+		args[2], args[3] = formatScore(lastSecond+1), formatScore(to)
+	}
+
+	firstMinute, lastMinute := math.Ceil(firstSecond/60), math.Floor((lastSecond+1)/60)-1
+	if firstMinute > lastMinute {
+		args[4], args[5] = formatScore(firstSecond), formatScore(lastSecond)
+		return args
+	}
+	if firstSecond < firstMinute*60 {
+		args[4], args[5] = formatScore(firstSecond), formatScore(firstMinute*60-1)
+	}
+	if !math.IsInf(lastSecond, 1) && (lastMinute+1)*60 <= lastSecond {
+		args[6], args[7] = formatScore((lastMinute+1)*60), formatScore(lastSecond)
+	}
+	args[8], args[9] = formatScore(firstMinute), formatScore(lastMinute)
+	return args
+}
+
+func (r *Redis) GetSummary(ctx context.Context, instance *config.Service, summary *models.SummaryParam) (*models.ProcessorSummary, error) {
+	from, to := math.Inf(-1), math.Inf(1)
+	if !summary.StartTime.IsZero() {
+		from = float64(summary.StartTime.UnixNano()) / 1e9
+	}
+	if !summary.EndTime.IsZero() {
+		to = float64(summary.EndTime.UnixNano()) / 1e9
+	}
+	res := &models.ProcessorSummary{}
+	if from > to {
+		return res, nil
+	}
+	args := append(summaryWindow(from, to), formatScore(from), formatScore(to), bucketsMigration(instance))
+	totals, err := summaryScript.Run(ctx, r.Rdb, migrationKeys(instance), args...).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read summary: %w", err)
+	}
+	res.RequestCount = int(totals[0])
+	res.TotalAmount = models.MinorUnits(totals[1])
+	return res, nil
+}
+
+// formatScore formats a score of the KeyTime sorted set or a bucket number,
+// infinities included.
+func formatScore(f float64) string {
+	switch {
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsInf(f, 1):
+		return "+inf"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// Purge empties the whole Redis database, queues included.
+func (r *Redis) Purge(ctx context.Context) error {
+	return r.Rdb.FlushDB(ctx).Err()
+}
+
+// HEALTH_KEY is the hash holding the health reports and the active processor.
+const HEALTH_KEY = "health"
+
+func (r *Redis) SetHealth(ctx context.Context, field, value string) error {
+	return r.Rdb.HSet(ctx, HEALTH_KEY, field, value).Err()
+}
+
+func (r *Redis) GetHealth(ctx context.Context, field string) (string, error) {
+	value, err := r.Rdb.HGet(ctx, HEALTH_KEY, field).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return value, err
+}
+
+func (r *Redis) SetString(ctx context.Context, key, label, value string) error {
 	return r.Rdb.HSet(ctx, key, label, value).Err()
 }
 
-func (r *Redis) GetString(key, label string) string {
-	ctx := context.Background()
+func (r *Redis) GetString(ctx context.Context, key, label string) string {
 	str, err := r.Rdb.HGet(ctx, key, label).Result()
 	if err != nil {
 		str = ""
@@ -106,12 +609,12 @@ func (r *Redis) GetString(key, label string) string {
 	return str
 }
 
-func (r *Redis) SetInt(key, label string, value int64) error {
-	return r.SetString(key, label, strconv.FormatInt(value, 10))
+func (r *Redis) SetInt(ctx context.Context, key, label string, value int64) error {
+	return r.SetString(ctx, key, label, strconv.FormatInt(value, 10))
 }
 
-func (r *Redis) GetInt(key, label string) int64 {
-	str := r.GetString(key, label)
+func (r *Redis) GetInt(ctx context.Context, key, label string) int64 {
+	str := r.GetString(ctx, key, label)
 	num, err := strconv.ParseInt(str, 10, 64)
 	if err != nil {
 		num = 0
@@ -119,21 +622,28 @@ func (r *Redis) GetInt(key, label string) int64 {
 	return num
 }
 
-func (r *Redis) TryLock(lockKey string, lockValue string, ttl time.Duration) bool {
-	success, err := r.Rdb.SetNX(r.ctx, lockKey, lockValue, ttl).Result()
-	if err != nil {
-		log.Printf("failed to acquire lock: %s", err.Error())
-		return false
-	}
-	return success
+func (r *Redis) Ping(ctx context.Context) error {
+	return r.Rdb.Ping(ctx).Err()
 }
 
-func (r *Redis) Unlock(lockKey string) error {
-	return r.Rdb.Del(r.ctx, lockKey).Err()
+func (r *Redis) TryLock(ctx context.Context, lockKey string, lockValue string, ttl time.Duration) (bool, error) {
+	return r.Rdb.SetNX(ctx, lockKey, lockValue, ttl).Result()
+}
+
+var releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Unlock deletes lockKey only if it is still held with lockValue.
+func (r *Redis) Unlock(ctx context.Context, lockKey string, lockValue string) error {
+	return releaseLockScript.Run(ctx, r.Rdb, []string{lockKey}, lockValue).Err()
 }
 
-func (r *Redis) GetLastRunTime(timeKey string) (time.Time, error) {
-	result, err := r.Rdb.Get(r.ctx, timeKey).Result()
+func (r *Redis) GetLastRunTime(ctx context.Context, timeKey string) (time.Time, error) {
+	result, err := r.Rdb.Get(ctx, timeKey).Result()
 	if err == redis.Nil {
 		return time.Time{}, nil
 	}
@@ -147,24 +657,24 @@ func (r *Redis) GetLastRunTime(timeKey string) (time.Time, error) {
 	return t, nil
 }
 
-func (r *Redis) SetLastRunTime(timeKey string, t time.Time) error {
-	err := r.Rdb.Set(r.ctx, timeKey, t.Format(time.RFC3339Nano), 0).Err()
+func (r *Redis) SetLastRunTime(ctx context.Context, timeKey string, t time.Time) error {
+	err := r.Rdb.Set(ctx, timeKey, t.Format(time.RFC3339Nano), 0).Err()
 	if err != nil {
 		return fmt.Errorf("failed to set last run time: %w", err)
 	}
 	return nil
 }
 
-func (r *Redis) ResetStat(key string) error {
-	return r.Rdb.Set(r.ctx, key, "0", 0).Err()
+func (r *Redis) ResetStat(ctx context.Context, key string) error {
+	return r.Rdb.Set(ctx, key, "0", 0).Err()
 }
 
-func (r *Redis) AddStat(key string) error {
-	return r.Rdb.Incr(r.ctx, key).Err()
+func (r *Redis) AddStat(ctx context.Context, key string) error {
+	return r.Rdb.Incr(ctx, key).Err()
 }
 
-func (r *Redis) GetStat(key string) int64 {
-	result, err := r.Rdb.Get(r.ctx, key).Result()
+func (r *Redis) GetStat(ctx context.Context, key string) int64 {
+	result, err := r.Rdb.Get(ctx, key).Result()
 	if err == redis.Nil || err != nil {
 		return 0
 	}
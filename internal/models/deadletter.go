@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// DeadLetter is a payment that was given up on, with the last failure seen.
+type DeadLetter struct {
+	Payment        *Payment  `json:"payment"`
+	Reason         string    `json:"reason"`
+	StatusCode     int       `json:"statusCode"`
+	Attempts       int       `json:"attempts"`
+	FirstAttemptAt time.Time `json:"firstAttemptAt"`
+	LastAttemptAt  time.Time `json:"lastAttemptAt"`
+}
@@ -1,6 +1,27 @@
 package models
 
+import "time"
+
 type HealthResponse struct {
 	Failing         bool   `json:"failing"`
 	MinResponseTime uint32 `json:"minResponseTime"`
 }
+
+// ForwardStats sums the forwards to one processor over a time bucket.
+type ForwardStats struct {
+	Count    int64
+	Failures int64
+	Latency  time.Duration // Total over the forwards
+}
+
+// Readiness is reported by the API readiness endpoint.
+type Readiness struct {
+	Ready  bool             `json:"ready"`
+	Checks []ReadinessCheck `json:"checks"`
+}
+
+type ReadinessCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
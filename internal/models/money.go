@@ -0,0 +1,175 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// MONEY_SCALE is the number of decimal places of the service currency.
+const MONEY_SCALE = 2
+
+var moneyUnit = int64(math.Pow10(MONEY_SCALE))
+
+// Money is an amount of the service currency held in minor units (cents), so
+// that sums are exact however many payments they add up. It is a struct
+// rather than an integer so that the JSON decoder goes through UnmarshalJSON.
+type Money struct {
+	minor int64
+}
+
+// MinorUnits returns the amount of n minor units.
+func MinorUnits(n int64) Money {
+	return Money{minor: n}
+}
+
+// ParseMoney parses a decimal amount such as "19.90" or "1.99e1". Digits
+// past MONEY_SCALE are rounded half away from zero.
+func ParseMoney(s string) (Money, error) {
+	dec := s
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		var ok bool
+		if dec, ok = shiftPoint(s[:i], s[i+1:]); !ok {
+			return Money{}, fmt.Errorf("invalid amount %q", s)
+		}
+	}
+	negative := strings.HasPrefix(dec, "-")
+	units, frac, _ := strings.Cut(strings.TrimPrefix(dec, "-"), ".")
+	if units == "" && frac == "" {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	var extra string
+	if len(frac) > MONEY_SCALE {
+		frac, extra = frac[:MONEY_SCALE], frac[MONEY_SCALE:]
+	}
+	digits := units + frac + strings.Repeat("0", MONEY_SCALE-len(frac))
+	if !isDigits(digits) || !isDigits(extra) {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	minor, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	if extra != "" && extra[0] >= '5' {
+		if minor == math.MaxInt64 {
+			return Money{}, fmt.Errorf("invalid amount %q", s)
+		}
+		minor++
+	}
+	if negative {
+		minor = -minor
+	}
+	return Money{minor: minor}, nil
+}
+
+// maxExponent bounds the exponents ParseMoney accepts, far past any amount
+// that fits.
+const maxExponent = 64
+
+// shiftPoint writes mantissa times ten to the power of exp without the
+// exponent, e.g. "1.5" and "-2" as "0.015", so that it is parsed exactly.
+func shiftPoint(mantissa, exp string) (string, bool) {
+	e, err := strconv.Atoi(exp)
+	if err != nil || e < -maxExponent || e > maxExponent {
+		return "", false
+	}
+	sign := ""
+	if strings.HasPrefix(mantissa, "-") {
+		sign, mantissa = "-", mantissa[1:]
+	}
+	units, frac, _ := strings.Cut(mantissa, ".")
+	digits := units + frac
+	if digits == "" || !isDigits(digits) {
+		return "", false
+	}
+	point := len(units) + e
+	if point < 0 {
+		digits = strings.Repeat("0", -point) + digits
+		point = 0
+	}
+	if point > len(digits) {
+		digits += strings.Repeat("0", point-len(digits))
+	}
+	return sign + digits[:point] + "." + digits[point:], true
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// MinorUnits returns the amount in minor units.
+func (m Money) MinorUnits() int64 {
+	return m.minor
+}
+
+// Float64 returns the amount in major units, for metrics and tracing only.
+func (m Money) Float64() float64 {
+	return float64(m.minor) / float64(moneyUnit)
+}
+
+func (m Money) Add(o Money) Money {
+	return Money{minor: m.minor + o.minor}
+}
+
+func (m Money) Sub(o Money) Money {
+	return Money{minor: m.minor - o.minor}
+}
+
+// MulRate returns m multiplied by rate, rounded to the nearest minor unit.
+func (m Money) MulRate(rate float64) Money {
+	return Money{minor: int64(math.Round(float64(m.minor) * rate))}
+}
+
+// String formats the amount with exactly MONEY_SCALE decimals, e.g. "19.90".
+func (m Money) String() string {
+	return string(m.appendTo(nil))
+}
+
+// appendTo appends the String form of m to b.
+func (m Money) appendTo(b []byte) []byte {
+	minor := m.minor
+	if minor < 0 {
+		b = append(b, '-')
+	}
+	// Negating math.MinInt64 is avoided by working on unsigned values.
+	u := uint64(minor)
+	if minor < 0 {
+		u = -u
+	}
+	unit := uint64(moneyUnit)
+	b = strconv.AppendUint(b, u/unit, 10)
+	b = append(b, '.')
+	frac := strconv.FormatUint(u%unit, 10)
+	for i := len(frac); i < MONEY_SCALE; i++ {
+		b = append(b, '0')
+	}
+	return append(b, frac...)
+}
+
+// MarshalJSON writes the amount as a JSON number with MONEY_SCALE decimals.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return m.appendTo(nil), nil
+}
+
+// UnmarshalJSON accepts a JSON number or, for hand-written payloads, a
+// string holding one. oj hands numbers over as a float64 written back in its
+// shortest form, which is still exact for the 14 significant digits of a
+// ledger amount.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "null" {
+		return nil
+	}
+	parsed, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
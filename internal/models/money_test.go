@@ -0,0 +1,171 @@
+package models
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ohler55/ojg/oj"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"19.90", 1990},
+		{"19.9", 1990},
+		{"19", 1900},
+		{"19.", 1900},
+		{".5", 50},
+		{"0", 0},
+		{"-0.00", 0},
+		{"1.004", 100},
+		{"1.005", 101},
+		{"1.0049999", 100},
+		{"1.995", 200},
+		{"0.125", 13},
+		{"-1.005", -101},
+		{"-1.004", -100},
+		{"-19.90", -1990},
+		{"1e2", 10000},
+		{"1.5E+2", 15000},
+		{"1.99e1", 1990},
+		{"1e-2", 1},
+		{"1e-3", 0},
+		{"1.005e0", 101},
+		{"100.5e-2", 101},
+		{"-2.5e-2", -3},
+		{"92233720368547758.07", math.MaxInt64},
+		{"-92233720368547758.07", -math.MaxInt64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseMoney(tt.in)
+			if err != nil {
+				t.Fatalf("ParseMoney(%q) error: %v", tt.in, err)
+			}
+			if got.MinorUnits() != tt.want {
+				t.Errorf("ParseMoney(%q) = %d, want %d", tt.in, got.MinorUnits(), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMoneyInvalid(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"-",
+		".",
+		"abc",
+		"+1",
+		"1,5",
+		"1.2.3",
+		"1.0x",
+		" 1",
+		"e5",
+		"1e",
+		"1e1.5",
+		"1.2.3e1",
+		"1e65",
+		"1e-65",
+		"NaN",
+		"Inf",
+		"92233720368547758.08",  // Past math.MaxInt64 minor units
+		"92233720368547758.075", // Rounds past it
+		"100000000000000000000", // Too many digits
+		"9.3e17",
+	} {
+		if got, err := ParseMoney(in); err == nil {
+			t.Errorf("ParseMoney(%q) = %v, want an error", in, got)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		minor int64
+		want  string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{50, "0.50"},
+		{1990, "19.90"},
+		{-5, "-0.05"},
+		{-1990, "-19.90"},
+		{math.MaxInt64, "92233720368547758.07"},
+		{math.MinInt64, "-92233720368547758.08"},
+	}
+	for _, tt := range tests {
+		if got := MinorUnits(tt.minor).String(); got != tt.want {
+			t.Errorf("MinorUnits(%d).String() = %q, want %q", tt.minor, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyMulRate(t *testing.T) {
+	tests := []struct {
+		minor int64
+		rate  float64
+		want  int64
+	}{
+		{1990, 0.05, 100}, // 99.5 rounds up
+		{1990, 0.15, 299}, // 298.5 rounds up
+		{1000, 0, 0},
+		{1000, 1, 1000},
+		{1, 0.4, 0},
+		{1, 0.5, 1},
+		{-1990, 0.05, -100}, // Half away from zero
+		{123456789, 0.05, 6172839},
+	}
+	for _, tt := range tests {
+		if got := MinorUnits(tt.minor).MulRate(tt.rate).MinorUnits(); got != tt.want {
+			t.Errorf("MinorUnits(%d).MulRate(%v) = %d, want %d", tt.minor, tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{`19.9`, 1990},
+		{`"19.90"`, 1990},
+		{`1.005`, 101},
+		{`-3`, -300},
+		{`null`, 42}, // Left untouched
+	}
+	for _, tt := range tests {
+		m := MinorUnits(42)
+		if err := m.UnmarshalJSON([]byte(tt.in)); err != nil {
+			t.Fatalf("UnmarshalJSON(%s) error: %v", tt.in, err)
+		}
+		if m.MinorUnits() != tt.want {
+			t.Errorf("UnmarshalJSON(%s) = %d, want %d", tt.in, m.MinorUnits(), tt.want)
+		}
+	}
+	var m Money
+	if err := m.UnmarshalJSON([]byte(`"ten"`)); err == nil {
+		t.Errorf(`UnmarshalJSON("ten") = %v, want an error`, m)
+	}
+}
+
+func TestMoneyJSONRoundTrip(t *testing.T) {
+	type record struct {
+		Amount Money `json:"amount"`
+	}
+	for _, minor := range []int64{0, 1, 10, 1990, -1990, 99999999999999} {
+		in := record{Amount: MinorUnits(minor)}
+		data, err := oj.Marshal(&in)
+		if err != nil {
+			t.Fatalf("oj.Marshal(%d) error: %v", minor, err)
+		}
+		var out record
+		if err := oj.Unmarshal(data, &out); err != nil {
+			t.Fatalf("oj.Unmarshal(%s) error: %v", data, err)
+		}
+		if out.Amount != in.Amount {
+			t.Errorf("round trip of %d through %s = %d", minor, data, out.Amount.MinorUnits())
+		}
+	}
+}
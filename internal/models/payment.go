@@ -5,7 +5,45 @@ import (
 )
 
 type Payment struct {
-	PaymentID string    `json:"correlationId" binding:"required"`
-	Amount    float64   `json:"amount" binding:"required,ge=0"` // Amount in dollars (e.g., 99.99)
+	PaymentID   string    `json:"correlationId"`
+	Amount      Money     `json:"amount"` // Amount in dollars (e.g., 99.99)
+	Timestamp   time.Time `json:"requestedAt"`
+	Attempts    int       `json:"attempts,omitempty"`    // Forward attempts made so far
+	TraceParent string    `json:"traceparent,omitempty"` // W3C trace context of the intake request
+	QueueID     string    `json:"-"`                     // Stream entry ID while the payment is pending in the queue
+	LogSeq      uint64    `json:"-"`                     // Write-ahead log record while this instance is responsible for it
+	Processor   string    `json:"-"`                     // Name of the processor that accepted it, once done
+}
+
+// Outcomes of a payment reported to a synchronous POST /payments.
+const (
+	PAYMENT_RESULT_PROCESSED = "processed"
+	PAYMENT_RESULT_FAILED    = "failed"
+)
+
+// PaymentResult is the final outcome of a payment, the answer of POST
+// /payments when the client asked to wait for it.
+type PaymentResult struct {
+	PaymentID string    `json:"correlationId"`
+	Status    string    `json:"status"`
+	Processor string    `json:"processor,omitempty"`
+	Amount    Money     `json:"amount"`
 	Timestamp time.Time `json:"requestedAt"`
+	Reason    string    `json:"reason,omitempty"` // Last failure of a failed payment
 }
+
+// PaymentRequest is the body sent to the payment processors.
+type PaymentRequest struct {
+	PaymentID string    `json:"correlationId"`
+	Amount    Money     `json:"amount"`
+	Timestamp time.Time `json:"requestedAt"`
+}
+
+// States of the idempotency record of a payment. Busy is not stored: it is
+// returned when another worker holds the forwarding lease.
+const (
+	PAYMENT_STATE_ACCEPTED = "accepted"
+	PAYMENT_STATE_INFLIGHT = "inflight"
+	PAYMENT_STATE_DONE     = "done"
+	PAYMENT_STATE_BUSY     = "busy"
+)
@@ -0,0 +1,18 @@
+package models
+
+// Problem is an RFC 7807 error body, sent as application/problem+json by
+// every endpoint. Type is about:blank, so Title is the HTTP status text.
+type Problem struct {
+	Type   string         `json:"type"`
+	Title  string         `json:"title"`
+	Status int            `json:"status"`
+	Detail string         `json:"detail,omitempty"`
+	Errors []ProblemField `json:"errors,omitempty"`
+}
+
+// ProblemField points at one invalid member of a request, as a JSON Pointer
+// into the body or the name of a query parameter.
+type ProblemField struct {
+	Pointer string `json:"pointer"`
+	Detail  string `json:"detail"`
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+)
+
+// ReconcileRange compares the summary stored for a processor with the one
+// the processor reports, over an inclusive time range.
+type ReconcileRange struct {
+	From   time.Time        `json:"from"`
+	To     time.Time        `json:"to"`
+	Local  ProcessorSummary `json:"local"`
+	Remote ProcessorSummary `json:"remote"`
+}
+
+// Matches reports whether both sides agree on the count and the amount.
+func (r *ReconcileRange) Matches() bool {
+	return r.Local == r.Remote
+}
+
+// ReconcileReport is the outcome of the last reconciliation of a processor.
+// Mismatches are the shortest ranges the bisection narrowed the differences
+// of Window down to.
+type ReconcileReport struct {
+	Processor  string           `json:"processor"`
+	CheckedAt  time.Time        `json:"checkedAt"`
+	Matched    bool             `json:"matched"`
+	Window     ReconcileRange   `json:"window"`
+	Mismatches []ReconcileRange `json:"mismatches,omitempty"`
+	Error      string           `json:"error,omitempty"`
+}
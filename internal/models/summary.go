@@ -1,28 +1,41 @@
 package models
 
+import "time"
+
 type SummaryRequest struct {
 	StartTime string `query:"from"`
 	EndTime   string `query:"to"`
 }
 
+// SummaryParam is the inclusive time window of a summary. A zero bound leaves
+// that side of the window open.
 type SummaryParam struct {
-	StartTime string
-	EndTime   string
+	StartTime time.Time
+	EndTime   time.Time
 }
 
+// PaymentSummary is the summary of a processor with the fees it charged.
+// FeePerTransaction is the fee rate of the processor, or the effective rate
+// of a combined total.
 type PaymentSummary struct {
 	RequestCount      int     `json:"totalRequests"`
-	TotalAmount       float64 `json:"totalAmount"`
-	TotalFee          float64 `json:"totalFee"`
+	TotalAmount       Money   `json:"totalAmount"`
+	TotalFee          Money   `json:"totalFee"`
+	NetAmount         Money   `json:"netAmount"`
 	FeePerTransaction float64 `json:"feePerTransaction"`
 }
 
-type ProcessorSummary struct {
-	RequestCount int     `json:"totalRequests"`
-	TotalAmount  float64 `json:"totalAmount"`
+// FeeSummaryResponse has the fee-aware summary of each registered processor,
+// keyed by name, and their combined total.
+type FeeSummaryResponse struct {
+	Processors map[string]*PaymentSummary `json:"processors"`
+	Total      *PaymentSummary            `json:"total"`
 }
 
-type SummaryResponse struct {
-	Default  *ProcessorSummary `json:"default"`
-	Fallback *ProcessorSummary `json:"fallback"`
+type ProcessorSummary struct {
+	RequestCount int   `json:"totalRequests"`
+	TotalAmount  Money `json:"totalAmount"`
 }
+
+// SummaryResponse has one entry per registered processor, keyed by name.
+type SummaryResponse map[string]*ProcessorSummary
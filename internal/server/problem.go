@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"rinha-2025-go/internal/models"
+	"rinha-2025-go/internal/services"
+
+	"github.com/ohler55/ojg/oj"
+	"github.com/valyala/fasthttp"
+)
+
+const contentTypeProblem = "application/problem+json"
+
+// writeProblem answers with an RFC 7807 body. Detail is left out when empty.
+func writeProblem(c *fasthttp.RequestCtx, status int, detail string, fields ...models.ProblemField) {
+	problem := models.Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Errors: fields,
+	}
+	bufPtr := services.BufferPool.Get().(*[]byte)
+	defer services.BufferPool.Put(bufPtr)
+	body, err := oj.Marshal(&problem, *bufPtr)
+	if err != nil {
+		c.Error(detail, status)
+		return
+	}
+	c.SetContentType(contentTypeProblem)
+	c.SetStatusCode(status)
+	c.SetBody(body)
+}
+
+// writeError answers with a problem for an unexpected failure.
+func writeError(c *fasthttp.RequestCtx, status int, err error) {
+	writeProblem(c, status, err.Error())
+}
+
+func notFound(c *fasthttp.RequestCtx) {
+	writeProblem(c, fasthttp.StatusNotFound, "")
+}
+
+func methodNotAllowed(c *fasthttp.RequestCtx) {
+	writeProblem(c, fasthttp.StatusMethodNotAllowed, "")
+}
@@ -1,7 +1,10 @@
 package server
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -9,40 +12,104 @@ import (
 	"rinha-2025-go/internal/config"
 	"rinha-2025-go/internal/models"
 	"rinha-2025-go/internal/services"
+	"rinha-2025-go/pkg/logging"
+	"rinha-2025-go/pkg/metrics"
+	"rinha-2025-go/pkg/tracing"
 	"rinha-2025-go/pkg/utils"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ohler55/ojg/oj"
 	"github.com/valyala/fasthttp"
 )
 
-func PostPayment(worker *services.PaymentWorker) func(c *fasthttp.RequestCtx) {
-	return func(c *fasthttp.RequestCtx) {
-		body := make([]byte, len(c.PostBody()))
-		copy(body, c.PostBody())
-		var payment models.Payment
-		if err := oj.Unmarshal(body, &payment); err != nil {
-			c.Error(err.Error(), fasthttp.StatusBadRequest)
+func PostPayment(worker *services.PaymentWorker) func(ctx context.Context, c *fasthttp.RequestCtx) {
+	return func(ctx context.Context, c *fasthttp.RequestCtx) {
+		payment, reqErr := decodePayment(c.PostBody())
+		if reqErr != nil {
+			reqErr.write(c)
+			return
+		}
+		span := tracing.StartFrom("POST /payments", tracing.KindServer, utils.UnsafeString(c.Request.Header.Peek("traceparent")))
+		defer span.End()
+		span.SetString("payment.id", payment.PaymentID)
+		// requestedAt is stamped once, when the payment is first forwarded.
+		payment.TraceParent = span.TraceParent()
+		accepted, err := worker.AcceptPayment(ctx, payment)
+		if err != nil {
+			span.SetError(err)
+			writeError(c, fasthttp.StatusServiceUnavailable, err)
+			return
+		}
+		// A retried correlationId gets the same answer without being enqueued again.
+		if !accepted {
+			c.SetStatusCode(fasthttp.StatusAccepted)
 			return
 		}
-		go worker.EnqueuePayment(&payment)
-		c.SetStatusCode(fasthttp.StatusAccepted)
+		wait := preferredWait(c.Request.Header.Peek("Prefer"))
+		if wait <= 0 {
+			worker.SubmitPayment(payment)
+			c.SetStatusCode(fasthttp.StatusAccepted)
+			return
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			wait = time.Until(deadline)
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, wait)
+		defer cancel()
+		result := worker.WaitPayment(waitCtx, payment)
+		// The wait that bounded the answer, shorter than the preference when
+		// the request deadline cut it, in whole seconds rounded up.
+		if wait > 0 {
+			seconds := (wait + time.Second - 1) / time.Second
+			c.Response.Header.Set("Preference-Applied", "wait="+strconv.Itoa(int(seconds)))
+		}
+		switch {
+		case result == nil:
+			c.SetStatusCode(fasthttp.StatusAccepted)
+		case result.Status == models.PAYMENT_RESULT_FAILED:
+			writeProblem(c, fasthttp.StatusBadGateway, "payment was not accepted by any processor: "+result.Reason)
+		default:
+			writeJSON(c, result)
+		}
 	}
 }
 
-func GetSummary(worker *services.PaymentWorker) func(c *fasthttp.RequestCtx) {
-	return func(c *fasthttp.RequestCtx) {
+// preferredWait returns the wait preference of an RFC 7240 Prefer header,
+// e.g. "wait=2", which asks POST /payments to answer with the outcome of the
+// payment if it is known within that many seconds. It returns 0 when absent
+// or invalid. The request timeout still bounds the wait.
+func preferredWait(header []byte) time.Duration {
+	for _, pref := range strings.Split(string(header), ",") {
+		pref, _, _ = strings.Cut(pref, ";")
+		name, value, ok := strings.Cut(strings.TrimSpace(pref), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "wait") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.Trim(strings.TrimSpace(value), `"`))
+		if err != nil || seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
+}
+
+func GetSummary(worker *services.PaymentWorker) func(ctx context.Context, c *fasthttp.RequestCtx) {
+	return func(ctx context.Context, c *fasthttp.RequestCtx) {
 		from := utils.UnsafeString(c.QueryArgs().Peek("from"))
 		to := utils.UnsafeString(c.QueryArgs().Peek("to"))
-		summary, err := worker.GetSummary(from, to)
+		summary, err := worker.GetSummary(ctx, from, to)
 		if err != nil {
-			c.Error(err.Error(), fasthttp.StatusInternalServerError)
+			writeSummaryError(c, err)
 			return
 		}
 		bufPtr := services.BufferPool.Get().(*[]byte)
 		defer services.BufferPool.Put(bufPtr)
 		body, err := oj.Marshal(summary, *bufPtr)
 		if err != nil {
-			c.Error(err.Error(), fasthttp.StatusInternalServerError)
+			writeError(c, fasthttp.StatusInternalServerError, err)
 			return
 		}
 		c.SetStatusCode(fasthttp.StatusOK)
@@ -50,51 +117,354 @@ func GetSummary(worker *services.PaymentWorker) func(c *fasthttp.RequestCtx) {
 	}
 }
 
-func PostPurgePayments(worker *services.PaymentWorker) func(c *fasthttp.RequestCtx) {
-	return func(c *fasthttp.RequestCtx) {
-		if err := worker.PurgePayments(); err != nil {
-			c.Error(err.Error(), fasthttp.StatusInternalServerError)
+// writeSummaryError answers a 400 for an invalid from/to window and a 500
+// for any other failure.
+func writeSummaryError(c *fasthttp.RequestCtx, err error) {
+	if errors.Is(err, services.ErrInvalidSummaryParam) {
+		writeProblem(c, fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+	writeError(c, fasthttp.StatusInternalServerError, err)
+}
+
+const feeSummaryPath = "/admin/payments-summary"
+
+// GetFeeSummary serves the payments summary with the gross, fee and net
+// amounts of each processor and their total, for the same from/to window.
+func GetFeeSummary(worker *services.PaymentWorker) func(ctx context.Context, c *fasthttp.RequestCtx) {
+	return func(ctx context.Context, c *fasthttp.RequestCtx) {
+		from := utils.UnsafeString(c.QueryArgs().Peek("from"))
+		to := utils.UnsafeString(c.QueryArgs().Peek("to"))
+		summary, err := worker.GetFeeSummary(ctx, from, to)
+		if err != nil {
+			writeSummaryError(c, err)
+			return
+		}
+		writeJSON(c, summary)
+	}
+}
+
+const reconcilePath = "/admin/reconciliation"
+
+// Reconciliation returns the reports of the last reconciliation (GET) or
+// runs one on this instance right away (POST).
+func Reconciliation(worker *services.PaymentWorker) func(ctx context.Context, c *fasthttp.RequestCtx) {
+	return func(ctx context.Context, c *fasthttp.RequestCtx) {
+		switch {
+		case c.IsGet():
+			reports, err := worker.ReconcileReports(ctx)
+			if err != nil {
+				writeError(c, fasthttp.StatusInternalServerError, err)
+				return
+			}
+			if reports == nil {
+				reports = []*models.ReconcileReport{}
+			}
+			writeJSON(c, reports)
+		case c.IsPost():
+			writeJSON(c, worker.Reconcile(ctx))
+		default:
+			methodNotAllowed(c)
+		}
+	}
+}
+
+func PostPurgePayments(worker *services.PaymentWorker) func(ctx context.Context, c *fasthttp.RequestCtx) {
+	return func(ctx context.Context, c *fasthttp.RequestCtx) {
+		if err := worker.PurgePayments(ctx); err != nil {
+			writeError(c, fasthttp.StatusInternalServerError, err)
 			return
 		}
 		c.SetStatusCode(http.StatusOK)
 	}
 }
 
+const deadLettersPath = "/admin/dead-letters"
+
+// DeadLetters serves the dead-letter admin API:
+//
+//	GET    /admin/dead-letters?offset=0&limit=100
+//	GET    /admin/dead-letters/{id}
+//	POST   /admin/dead-letters/{id}/replay
+//	DELETE /admin/dead-letters/{id}
+func DeadLetters(worker *services.PaymentWorker) func(ctx context.Context, c *fasthttp.RequestCtx) {
+	return func(ctx context.Context, c *fasthttp.RequestCtx) {
+		path := strings.TrimPrefix(string(c.Path()), deadLettersPath)
+		path = strings.Trim(path, "/")
+		id, action, _ := strings.Cut(path, "/")
+		switch {
+		case id == "" && c.IsGet():
+			offset, reqErr := queryUint(c, "offset", 0)
+			if reqErr != nil {
+				reqErr.write(c)
+				return
+			}
+			limit, reqErr := queryUint(c, "limit", 100)
+			if reqErr != nil {
+				reqErr.write(c)
+				return
+			}
+			if limit == 0 || limit > DEAD_LETTERS_LIMIT {
+				badRequest("invalid query parameter", models.ProblemField{
+					Pointer: "limit",
+					Detail:  fmt.Sprintf("must be between 1 and %d", DEAD_LETTERS_LIMIT),
+				}).write(c)
+				return
+			}
+			entries, err := worker.ListDeadLetters(ctx, offset, limit)
+			if err != nil {
+				writeError(c, fasthttp.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(c, entries)
+		case id != "" && action == "" && c.IsGet():
+			entry, err := worker.GetDeadLetter(ctx, id)
+			if err != nil {
+				writeError(c, fasthttp.StatusInternalServerError, err)
+				return
+			}
+			if entry == nil {
+				notFound(c)
+				return
+			}
+			writeJSON(c, entry)
+		case id != "" && action == "replay" && c.IsPost():
+			found, err := worker.ReplayDeadLetter(ctx, id)
+			replyFound(c, found, err)
+		case id != "" && action == "" && c.IsDelete():
+			found, err := worker.DiscardDeadLetter(ctx, id)
+			replyFound(c, found, err)
+		default:
+			notFound(c)
+		}
+	}
+}
+
+func replyFound(c *fasthttp.RequestCtx, found bool, err error) {
+	if err != nil {
+		writeError(c, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		notFound(c)
+		return
+	}
+	c.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+func writeJSON(c *fasthttp.RequestCtx, value any) {
+	bufPtr := services.BufferPool.Get().(*[]byte)
+	defer services.BufferPool.Put(bufPtr)
+	body, err := oj.Marshal(value, *bufPtr)
+	if err != nil {
+		writeError(c, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	c.SetContentType("application/json")
+	c.SetStatusCode(fasthttp.StatusOK)
+	c.SetBody(body)
+}
+
 func NewListenSocket(socketPath string) net.Listener {
 	if err := os.MkdirAll(filepath.Dir(socketPath), 0777); err != nil {
-		log.Fatalf("Failed to create socket directory: %v", err)
+		fatal("failed to create socket directory", err)
 	}
 	if err := os.RemoveAll(socketPath); err != nil {
-		log.Fatalf("Failed to remove existing socket: %v", err)
+		fatal("failed to remove existing socket", err)
 	}
 	listener, err := net.Listen("unix", socketPath)
 	if err != nil {
-		log.Fatalf("Failed to listen on Unix socket: %v", err)
+		fatal("failed to listen on unix socket", err)
 	}
 	if err := os.Chmod(socketPath, 0666); err != nil {
-		log.Fatalf("Failed to set socket permissions: %v", err)
+		fatal("failed to set socket permissions", err)
 	}
 	return listener
 }
 
-func RunServer(cfg *config.Config, worker *services.PaymentWorker) error {
-	handlers := fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
-		switch string(ctx.Path()) {
-		case "/payments":
-			PostPayment(worker)(ctx)
-		case "/payments-summary":
-			GetSummary(worker)(ctx)
-		case "/purge-payments":
-			PostPurgePayments(worker)(ctx)
+func fatal(msg string, err error) {
+	slog.Error(msg, logging.Err(err))
+	os.Exit(1)
+}
+
+const logLevelPath = "/admin/log-level"
+
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+// LogLevel reads (GET) or changes (PUT or POST, {"level":"debug"}) the
+// minimum log level without a restart.
+func LogLevel() func(c *fasthttp.RequestCtx) {
+	return func(c *fasthttp.RequestCtx) {
+		switch {
+		case c.IsGet():
+		case c.IsPut() || c.IsPost():
+			var body logLevelBody
+			if err := oj.Unmarshal(c.PostBody(), &body); err != nil {
+				badRequest("body is not valid JSON: " + err.Error()).write(c)
+				return
+			}
+			level, err := logging.ParseLevel(body.Level)
+			if err != nil {
+				writeProblem(c, fasthttp.StatusUnprocessableEntity, "log level is invalid",
+					models.ProblemField{Pointer: "/level", Detail: err.Error()})
+				return
+			}
+			if previous := logging.Level(); level != previous {
+				logging.SetLevel(level)
+				slog.Warn("log level changed", "from", previous.String(), "to", level.String())
+			}
+		default:
+			methodNotAllowed(c)
+			return
+		}
+		writeJSON(c, &logLevelBody{Level: logging.Level().String()})
+	}
+}
+
+var (
+	httpRequests = metrics.NewCounterVec("http_requests_total",
+		"HTTP requests served, by route and status code.", "route", "code")
+	httpDuration = metrics.NewHistogramVec("http_request_duration_seconds",
+		"Latency of HTTP requests, by route.", metrics.DefBuckets, "route")
+)
+
+// GetLive answers as long as the server is serving requests.
+func GetLive() func(c *fasthttp.RequestCtx) {
+	return func(c *fasthttp.RequestCtx) {
+		c.SetContentType("application/json")
+		c.SetStatusCode(fasthttp.StatusOK)
+		c.SetBodyString(`{"live":true}`)
+	}
+}
+
+// GetReady reports the readiness checks, with a 503 when any of them fails
+// so load balancers take the instance out of rotation.
+func GetReady(worker *services.PaymentWorker) func(ctx context.Context, c *fasthttp.RequestCtx) {
+	return func(ctx context.Context, c *fasthttp.RequestCtx) {
+		readiness := worker.Readiness(ctx)
+		writeJSON(c, readiness)
+		if !readiness.Ready {
+			c.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		}
+	}
+}
+
+func GetMetrics() func(c *fasthttp.RequestCtx) {
+	return func(c *fasthttp.RequestCtx) {
+		c.SetContentType("text/plain; version=0.0.4")
+		c.SetStatusCode(fasthttp.StatusOK)
+		if _, err := metrics.Default.WriteTo(c); err != nil {
+			writeError(c, fasthttp.StatusInternalServerError, err)
+		}
+	}
+}
+
+// Server is the HTTP API, on a Unix socket or on :9999.
+type Server struct {
+	cfg  *config.Config
+	http *fasthttp.Server
+}
+
+func NewServer(cfg *config.Config, worker *services.PaymentWorker) *Server {
+	handlers := fasthttp.RequestHandler(func(c *fasthttp.RequestCtx) {
+		start := time.Now()
+		// Not derived from c: its Done channel is closed as soon as shutdown
+		// starts, and requests in progress should still complete.
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+		defer cancel()
+		// Route labels are constants so the metric cardinality stays bounded.
+		var route string
+		switch path := utils.UnsafeString(c.Path()); {
+		case path == "/payments":
+			route = "/payments"
+			if allow(c, fasthttp.MethodPost) {
+				PostPayment(worker)(ctx, c)
+			}
+		case path == "/payments-summary":
+			route = "/payments-summary"
+			if allow(c, fasthttp.MethodGet) {
+				GetSummary(worker)(ctx, c)
+			}
+		case path == feeSummaryPath:
+			route = feeSummaryPath
+			if allow(c, fasthttp.MethodGet) {
+				GetFeeSummary(worker)(ctx, c)
+			}
+		case path == reconcilePath:
+			route = reconcilePath
+			Reconciliation(worker)(ctx, c)
+		case path == "/purge-payments":
+			route = "/purge-payments"
+			if allow(c, fasthttp.MethodPost) {
+				PostPurgePayments(worker)(ctx, c)
+			}
+		case path == "/metrics":
+			route = "/metrics"
+			GetMetrics()(c)
+		case path == "/health/live":
+			route = "/health/live"
+			GetLive()(c)
+		case path == "/health/ready" || path == "/health":
+			route = "/health/ready"
+			GetReady(worker)(ctx, c)
+		case path == logLevelPath:
+			route = logLevelPath
+			LogLevel()(c)
+		case strings.HasPrefix(path, deadLettersPath):
+			route = deadLettersPath
+			DeadLetters(worker)(ctx, c)
 		default:
-			ctx.Error("Not Found", fasthttp.StatusNotFound)
+			route = "other"
+			notFound(c)
 		}
+		httpDuration.With(route).Since(start)
+		httpRequests.With(route, metrics.StatusLabel(c.Response.StatusCode())).Inc()
 	})
+	return &Server{cfg: cfg, http: &fasthttp.Server{
+		Handler:            handlers,
+		MaxRequestBodySize: SERVER_MAX_BODY,
+		ErrorHandler:       requestParseError,
+	}}
+}
+
+// allow answers a 405 and reports false unless the request uses method.
+func allow(c *fasthttp.RequestCtx, method string) bool {
+	if string(c.Method()) == method {
+		return true
+	}
+	c.Response.Header.Set(fasthttp.HeaderAllow, method)
+	methodNotAllowed(c)
+	return false
+}
 
-	if cfg.ServerSocket == "" {
-		return fasthttp.ListenAndServe(":9999", handlers)
+// requestParseError answers requests fasthttp could not read.
+func requestParseError(c *fasthttp.RequestCtx, err error) {
+	if errors.Is(err, fasthttp.ErrBodyTooLarge) {
+		writeProblem(c, fasthttp.StatusRequestEntityTooLarge,
+			fmt.Sprintf("body must not exceed %d bytes", SERVER_MAX_BODY))
+		return
 	}
+	writeProblem(c, fasthttp.StatusBadRequest, "malformed request")
+}
 
-	defer os.Remove(cfg.ServerSocket)
-	return fasthttp.ListenAndServeUNIX(cfg.ServerSocket, 0666, handlers)
+// ListenAndServe serves requests until Shutdown is called.
+func (s *Server) ListenAndServe() error {
+	if s.cfg.ServerSocket == "" {
+		return s.http.ListenAndServe(":9999")
+	}
+	return s.http.ListenAndServeUNIX(s.cfg.ServerSocket, 0666)
+}
+
+// Shutdown stops accepting connections, waits for the requests being served
+// until ctx expires and removes the Unix socket.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.http.ShutdownWithContext(ctx)
+	if s.cfg.ServerSocket != "" {
+		if rmErr := os.Remove(s.cfg.ServerSocket); rmErr != nil && !os.IsNotExist(rmErr) {
+			err = errors.Join(err, rmErr)
+		}
+	}
+	return err
 }
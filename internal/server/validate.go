@@ -0,0 +1,286 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"rinha-2025-go/internal/models"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ohler55/ojg/oj"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	SERVER_MAX_BODY    = 64 << 10 // Any request body
+	PAYMENT_MAX_BODY   = 1 << 10
+	PAYMENT_MAX_AMOUNT = 1e12 // Exclusive, the NUMERIC(14, 2) of the ledger
+	DEAD_LETTERS_LIMIT = 1000 // Largest page of dead letters
+)
+
+// paymentFields are the members a payment request may have.
+var paymentFields = []string{"correlationId", "amount"}
+
+// requestError is a request rejected by validation. Malformed bodies,
+// unknown members and bad query parameters are a 400; well-formed requests
+// with invalid values a 422.
+type requestError struct {
+	status int
+	detail string
+	fields []models.ProblemField
+}
+
+func (e *requestError) Error() string {
+	return e.detail
+}
+
+func (e *requestError) write(c *fasthttp.RequestCtx) {
+	writeProblem(c, e.status, e.detail, e.fields...)
+}
+
+func badRequest(detail string, fields ...models.ProblemField) *requestError {
+	return &requestError{status: fasthttp.StatusBadRequest, detail: detail, fields: fields}
+}
+
+// decodePayment parses and validates the body of POST /payments.
+func decodePayment(body []byte) (*models.Payment, *requestError) {
+	if len(body) > PAYMENT_MAX_BODY {
+		return nil, &requestError{
+			status: fasthttp.StatusRequestEntityTooLarge,
+			detail: fmt.Sprintf("body must not exceed %d bytes", PAYMENT_MAX_BODY),
+		}
+	}
+	var tokens paymentTokens
+	if err := oj.Tokenize(body, &tokens); err != nil {
+		return nil, badRequest("body is not valid JSON: " + err.Error())
+	}
+	switch {
+	case tokens.values == 0 || tokens.depth != 0:
+		// The tokenizer stops without an error at the end of the body.
+		return nil, badRequest("body is not valid JSON: unexpected end of body")
+	case tokens.values > 1:
+		return nil, badRequest("body must hold a single JSON value")
+	case !tokens.object:
+		return nil, badRequest("body must be a JSON object")
+	}
+	// oj hands decimals over as a float64, which would round them before
+	// their precision is checked: the amount is read as written.
+	var amount string
+	if tokens.amount == tokenNumber {
+		amount = numberLiteral(body, tokens.amountIndex)
+		// The tokenizer lets fractions without digits through.
+		if strings.HasSuffix(amount, ".") || strings.Contains(strings.ToLower(amount), ".e") {
+			return nil, badRequest("body is not valid JSON: amount has a fraction without digits")
+		}
+	}
+	if len(tokens.unknown) > 0 {
+		slices.SortFunc(tokens.unknown, func(a, b models.ProblemField) int {
+			return strings.Compare(a.Pointer, b.Pointer)
+		})
+		return nil, badRequest("body has unknown members", tokens.unknown...)
+	}
+
+	var payment models.Payment
+	var invalid []models.ProblemField
+	switch {
+	case tokens.id == tokenNone:
+		invalid = append(invalid, models.ProblemField{Pointer: "/correlationId", Detail: "is required"})
+	case tokens.id != tokenString || !isUUID(tokens.idValue):
+		invalid = append(invalid, models.ProblemField{Pointer: "/correlationId", Detail: "must be a UUID"})
+	default:
+		payment.PaymentID = tokens.idValue
+	}
+	detail := "is required"
+	if tokens.amount == tokenNumber {
+		payment.Amount, detail = parseAmount(amount)
+	} else if tokens.amount != tokenNone {
+		detail = "must be a number"
+	}
+	if detail != "" {
+		invalid = append(invalid, models.ProblemField{Pointer: "/amount", Detail: detail})
+	}
+	if len(invalid) > 0 {
+		return nil, &requestError{
+			status: fasthttp.StatusUnprocessableEntity,
+			detail: "payment is invalid",
+			fields: invalid,
+		}
+	}
+	return &payment, nil
+}
+
+// Kinds of the values of a payment request member.
+const (
+	tokenNone = iota // Absent or null
+	tokenString
+	tokenNumber
+	tokenOther
+)
+
+// paymentTokens collects the members of a payment request as the oj
+// tokenizer reports them, without building a generic value.
+type paymentTokens struct {
+	depth   int
+	values  int  // Top-level values
+	object  bool // Whether the first one is an object
+	key     string
+	numbers int // Numbers seen so far, at any depth
+	unknown []models.ProblemField
+
+	id          int
+	idValue     string
+	amount      int
+	amountIndex int // Of the amount among the numbers of the body
+}
+
+// value records a value of kind. Members of the top-level object are
+// assigned; nested values only matter for their numbers.
+func (p *paymentTokens) value(kind int) {
+	if kind == tokenNumber {
+		p.numbers++
+	}
+	switch p.depth {
+	case 0:
+		p.values++
+	case 1:
+		switch p.key {
+		case "correlationId":
+			p.id = kind
+		case "amount":
+			p.amount = kind
+			p.amountIndex = p.numbers - 1
+		}
+	}
+}
+
+func (p *paymentTokens) Null()         { p.value(tokenNone) }
+func (p *paymentTokens) Bool(bool)     { p.value(tokenOther) }
+func (p *paymentTokens) Int(int64)     { p.value(tokenNumber) }
+func (p *paymentTokens) Float(float64) { p.value(tokenNumber) }
+func (p *paymentTokens) Number(string) { p.value(tokenNumber) }
+func (p *paymentTokens) ArrayEnd()     { p.depth-- }
+func (p *paymentTokens) ObjectEnd()    { p.depth-- }
+
+func (p *paymentTokens) String(s string) {
+	if p.depth == 1 && p.key == "correlationId" {
+		p.idValue = s
+	}
+	p.value(tokenString)
+}
+
+func (p *paymentTokens) ArrayStart() {
+	p.value(tokenOther)
+	p.depth++
+}
+
+func (p *paymentTokens) ObjectStart() {
+	if p.depth == 0 && p.values == 0 {
+		p.object = true
+	}
+	p.value(tokenOther)
+	p.depth++
+}
+
+func (p *paymentTokens) Key(key string) {
+	if p.depth != 1 {
+		return
+	}
+	p.key = key
+	if !slices.Contains(paymentFields, key) &&
+		!slices.ContainsFunc(p.unknown, func(f models.ProblemField) bool { return f.Pointer == "/"+key }) {
+		p.unknown = append(p.unknown, models.ProblemField{Pointer: "/" + key, Detail: "unknown member"})
+	}
+}
+
+// numberLiteral returns the number at index among those of body, a valid
+// JSON document, as written.
+func numberLiteral(body []byte, index int) string {
+	for i := 0; i < len(body); i++ {
+		switch c := body[i]; {
+		case c == '"':
+			for i++; i < len(body) && body[i] != '"'; i++ {
+				if body[i] == '\\' {
+					i++
+				}
+			}
+		case c == '-' || '0' <= c && c <= '9':
+			start := i
+			for i+1 < len(body) && strings.IndexByte("0123456789+-.eE", body[i+1]) >= 0 {
+				i++
+			}
+			if index == 0 {
+				return string(body[start : i+1])
+			}
+			index--
+		}
+	}
+	return ""
+}
+
+// maxAmount is PAYMENT_MAX_AMOUNT as Money.
+var maxAmount = models.MinorUnits(int64(PAYMENT_MAX_AMOUNT * math.Pow10(models.MONEY_SCALE)))
+
+// parseAmount checks an amount, as written in the body, and returns why it
+// is invalid, if it is.
+func parseAmount(number string) (models.Money, string) {
+	if decimalPlaces(number) > models.MONEY_SCALE {
+		return models.Money{}, fmt.Sprintf("must have at most %d decimal places", models.MONEY_SCALE)
+	}
+	amount, err := models.ParseMoney(number)
+	if err != nil || amount.MinorUnits() <= 0 || amount.MinorUnits() >= maxAmount.MinorUnits() {
+		return models.Money{}, fmt.Sprintf("must be positive and below %.0f", PAYMENT_MAX_AMOUNT)
+	}
+	return amount, ""
+}
+
+// maxCheckedExponent bounds the exponents decimalPlaces looks at. Any past it
+// is far outside of PAYMENT_MAX_AMOUNT, or below a minor unit.
+const maxCheckedExponent = 1000
+
+// decimalPlaces returns the number of decimal places a JSON number needs,
+// trailing zeros aside: 1 for "10.10000" and for "1010e-2", 0 for "1.5e1".
+func decimalPlaces(number string) int {
+	mantissa, exp, _ := strings.Cut(strings.ToLower(number), "e")
+	// The tokenizer checked the syntax. Atoi clamps exponents out of range.
+	e, _ := strconv.Atoi(exp)
+	e = min(max(e, -maxCheckedExponent), maxCheckedExponent)
+	units, frac, _ := strings.Cut(strings.TrimPrefix(mantissa, "-"), ".")
+	digits := strings.TrimRight(units+frac, "0")
+	return max(len(digits)-len(units)-e, 0)
+}
+
+// isUUID reports whether s is a UUID in its canonical 8-4-4-4-12 form.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// queryUint reads an optional unsigned query parameter, def when absent.
+func queryUint(c *fasthttp.RequestCtx, name string, def int64) (int64, *requestError) {
+	raw := c.QueryArgs().Peek(name)
+	if raw == nil {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil || n < 0 {
+		return 0, badRequest("invalid query parameter",
+			models.ProblemField{Pointer: name, Detail: "must be a non-negative integer"})
+	}
+	return n, nil
+}
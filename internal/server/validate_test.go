@@ -0,0 +1,148 @@
+package server
+
+import (
+	"rinha-2025-go/internal/models"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+const testID = "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3"
+
+func TestDecodePayment(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		status   int      // 0 when the payment is valid
+		pointers []string // Of the invalid fields
+		amount   int64    // Minor units, when valid
+	}{
+		{"valid", `{"correlationId":"` + testID + `","amount":19.90}`, 0, nil, 1990},
+		{"integer amount", `{"correlationId":"` + testID + `","amount":20}`, 0, nil, 2000},
+		{"exponent amount", `{"correlationId":"` + testID + `","amount":1.99e1}`, 0, nil, 1990},
+		{"trailing zeros", `{"correlationId":"` + testID + `","amount":10.10000}`, 0, nil, 1010},
+		{"not json", `{"correlationId":`, fasthttp.StatusBadRequest, nil, 0},
+		{"unclosed array", `{"correlationId":"` + testID + `","amount":[1`, fasthttp.StatusBadRequest, nil, 0},
+		{"fraction without digits", `{"correlationId":"` + testID + `","amount":1.}`, fasthttp.StatusBadRequest, nil, 0},
+		{"exponent after point", `{"correlationId":"` + testID + `","amount":1.e2}`, fasthttp.StatusBadRequest, nil, 0},
+		{"empty body", ``, fasthttp.StatusBadRequest, nil, 0},
+		{"trailing value", `{"correlationId":"` + testID + `","amount":1} {}`, fasthttp.StatusBadRequest, nil, 0},
+		{"array", `[1]`, fasthttp.StatusBadRequest, nil, 0},
+		{"null", `null`, fasthttp.StatusBadRequest, nil, 0},
+		{"unknown members", `{"correlationId":"` + testID + `","amount":1,"zeta":1,"alpha":2}`,
+			fasthttp.StatusBadRequest, []string{"/alpha", "/zeta"}, 0},
+		{"missing members", `{}`, fasthttp.StatusUnprocessableEntity, []string{"/correlationId", "/amount"}, 0},
+		{"bad uuid", `{"correlationId":"abc","amount":1}`, fasthttp.StatusUnprocessableEntity, []string{"/correlationId"}, 0},
+		{"uuid not a string", `{"correlationId":1,"amount":1}`, fasthttp.StatusUnprocessableEntity, []string{"/correlationId"}, 0},
+		{"amount as string", `{"correlationId":"` + testID + `","amount":"1.00"}`,
+			fasthttp.StatusUnprocessableEntity, []string{"/amount"}, 0},
+		{"amount as bool", `{"correlationId":"` + testID + `","amount":true}`,
+			fasthttp.StatusUnprocessableEntity, []string{"/amount"}, 0},
+		{"null amount", `{"correlationId":"` + testID + `","amount":null}`,
+			fasthttp.StatusUnprocessableEntity, []string{"/amount"}, 0},
+		{"zero amount", `{"correlationId":"` + testID + `","amount":0}`, fasthttp.StatusUnprocessableEntity, []string{"/amount"}, 0},
+		{"negative amount", `{"correlationId":"` + testID + `","amount":-1}`, fasthttp.StatusUnprocessableEntity, []string{"/amount"}, 0},
+		{"too precise", `{"correlationId":"` + testID + `","amount":10.10000000000000001}`,
+			fasthttp.StatusUnprocessableEntity, []string{"/amount"}, 0},
+		{"both invalid", `{"correlationId":"x","amount":0.001}`,
+			fasthttp.StatusUnprocessableEntity, []string{"/correlationId", "/amount"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payment, reqErr := decodePayment([]byte(tt.body))
+			if tt.status == 0 {
+				if reqErr != nil {
+					t.Fatalf("decodePayment() error: %d %s %v", reqErr.status, reqErr.detail, reqErr.fields)
+				}
+				if payment.PaymentID != testID {
+					t.Errorf("PaymentID = %q", payment.PaymentID)
+				}
+				if payment.Amount.MinorUnits() != tt.amount {
+					t.Errorf("Amount = %d, want %d", payment.Amount.MinorUnits(), tt.amount)
+				}
+				return
+			}
+			if reqErr == nil {
+				t.Fatalf("decodePayment() = %+v, want status %d", payment, tt.status)
+			}
+			if reqErr.status != tt.status {
+				t.Errorf("status = %d (%s), want %d", reqErr.status, reqErr.detail, tt.status)
+			}
+			var pointers []string
+			for _, field := range reqErr.fields {
+				pointers = append(pointers, field.Pointer)
+			}
+			if !slices.Equal(pointers, tt.pointers) {
+				t.Errorf("fields = %v, want %v", pointers, tt.pointers)
+			}
+		})
+	}
+}
+
+func TestDecodePaymentTooLarge(t *testing.T) {
+	body := `{"correlationId":"` + testID + `","amount":1` + strings.Repeat(" ", PAYMENT_MAX_BODY) + `}`
+	_, reqErr := decodePayment([]byte(body))
+	if reqErr == nil || reqErr.status != fasthttp.StatusRequestEntityTooLarge {
+		t.Fatalf("decodePayment() = %v, want status 413", reqErr)
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	const (
+		precision = "must have at most 2 decimal places"
+		outside   = "must be positive and below 1000000000000"
+	)
+	tests := []struct {
+		value  string
+		want   int64
+		detail string
+	}{
+		{"19.90", 1990, ""},
+		{"0.01", 1, ""},
+		{"10.10000000000000000", 1010, ""},
+		{"1010e-2", 1010, ""},
+		{"1.5E1", 1500, ""},
+		{"999999999999.99", 99999999999999, ""},
+		{"10.10000000000000001", 0, precision},
+		{"10.101", 0, precision},
+		{"0.001", 0, precision},
+		{"1e-3", 0, precision},
+		{"1e-99999999999999999999", 0, precision},
+		{"0", 0, outside},
+		{"-0.01", 0, outside},
+		{"1000000000000", 0, outside},
+		{"1e12", 0, outside},
+		{"1e99999999999999999999", 0, outside},
+	}
+	for _, tt := range tests {
+		got, detail := parseAmount(tt.value)
+		if detail != tt.detail || got != models.MinorUnits(tt.want) {
+			t.Errorf("parseAmount(%q) = %d, %q, want %d, %q", tt.value, got.MinorUnits(), detail, tt.want, tt.detail)
+		}
+	}
+}
+
+func TestIsUUID(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{testID, true},
+		{strings.ToUpper(testID), true},
+		{"00000000-0000-0000-0000-000000000000", true},
+		{"", false},
+		{"4a7901b87d264d9daa194dc1c7cf60b3", false},
+		{"4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b", false},
+		{"4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b30", false},
+		{"4a7901b8-7d26-4d9d-aa19_4dc1c7cf60b3", false},
+		{"4a7901b8-7d26-4d9d-aa19-4dc1c7cf60bg", false},
+		{"{4a7901b8-7d26-4d9d-aa19-4dc1c7cf60}", false},
+	}
+	for _, tt := range tests {
+		if got := isUUID(tt.in); got != tt.want {
+			t.Errorf("isUUID(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
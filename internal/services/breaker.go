@@ -0,0 +1,116 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"rinha-2025-go/internal/config"
+	"rinha-2025-go/pkg/logging"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	BREAKER_CLOSED    = "closed"
+	BREAKER_OPEN      = "open"
+	BREAKER_HALF_OPEN = "half-open"
+	BREAKER_TRIPPED   = "tripped"
+
+	BREAKER_PROBE = "breaker_probe:" // Lock key prefix of the half-open trial
+)
+
+// CircuitBreaker tracks consecutive forward failures per processor. Its state
+// lives in the shared store so every instance trips and recovers together.
+// Once OpenTimeout has passed an open breaker is half-open: a single trial
+// forward, across all instances, closes it on success or opens it again on
+// failure.
+type CircuitBreaker struct {
+	cfg   *config.Config
+	store Store
+	owner string
+
+	mu sync.Mutex
+	// Last time this instance reset each breaker on success. Successes are
+	// only written once per second while no failure is seen, to keep the
+	// hot path from paying a store round trip per payment.
+	lastReset map[string]time.Time
+}
+
+func NewCircuitBreaker(cfg *config.Config, store Store) *CircuitBreaker {
+	owner, _ := os.Hostname()
+	return &CircuitBreaker{
+		cfg:       cfg,
+		store:     store,
+		owner:     owner,
+		lastReset: make(map[string]time.Time),
+	}
+}
+
+// Record feeds the outcome of a forward to the breaker of instance and
+// reports whether it just tripped. Slow successes count as failures.
+func (b *CircuitBreaker) Record(ctx context.Context, instance *config.Service, status int, elapsed time.Duration) bool {
+	success := forwardSucceeded(status)
+	if b.cfg.Breaker.SlowCall > 0 && elapsed > b.cfg.Breaker.SlowCall {
+		success = false
+	}
+
+	b.mu.Lock()
+	if success && time.Since(b.lastReset[instance.Table]) < time.Second {
+		b.mu.Unlock()
+		return false
+	}
+	if success {
+		b.lastReset[instance.Table] = time.Now()
+	} else {
+		delete(b.lastReset, instance.Table)
+	}
+	b.mu.Unlock()
+
+	state, err := b.store.RecordBreaker(ctx, instance.Table, success,
+		b.cfg.Breaker.FailureThreshold, b.cfg.Breaker.OpenTimeout)
+	if err != nil {
+		slog.Error("record circuit breaker failed", logging.KeyProcessor, instance.Name, logging.Err(err))
+		return false
+	}
+	return state == BREAKER_TRIPPED
+}
+
+// forwardSucceeded tells whether a processor answered a forward in a way that
+// shows it is working. A 4xx is a verdict on the payment, not the processor.
+func forwardSucceeded(status int) bool {
+	return status != 0 && status < fasthttp.StatusInternalServerError
+}
+
+// State returns closed, open or half-open for instance.
+func (b *CircuitBreaker) State(ctx context.Context, instance *config.Service) string {
+	state, openedAt, err := b.store.GetBreaker(ctx, instance.Table)
+	if err != nil {
+		slog.Error("read circuit breaker failed", logging.KeyProcessor, instance.Name, logging.Err(err))
+		return BREAKER_CLOSED
+	}
+	if state == BREAKER_OPEN && time.Since(openedAt) >= b.cfg.Breaker.OpenTimeout {
+		return BREAKER_HALF_OPEN
+	}
+	return state
+}
+
+// IsOpen reports whether forwards to instance are held back. While the
+// breaker is half-open, the caller taking the probe token is told it is not
+// and must send the trial forward; everyone else sees it open until the
+// trial is recorded or the token expires after OpenTimeout.
+func (b *CircuitBreaker) IsOpen(ctx context.Context, instance *config.Service) bool {
+	switch b.State(ctx, instance) {
+	case BREAKER_CLOSED:
+		return false
+	case BREAKER_HALF_OPEN:
+		probe, err := b.store.TryLock(ctx, BREAKER_PROBE+instance.Table, b.owner, b.cfg.Breaker.OpenTimeout)
+		if err != nil {
+			slog.Error("take circuit breaker probe failed", logging.KeyProcessor, instance.Name, logging.Err(err))
+			return true
+		}
+		return !probe
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"context"
+	"rinha-2025-go/internal/config"
+	"rinha-2025-go/internal/database"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const testOpenTimeout = 20 * time.Millisecond
+
+// halfOpenBreaker returns a breaker of instance tripped and left open for
+// OpenTimeout.
+func halfOpenBreaker(t *testing.T, instance *config.Service) *CircuitBreaker {
+	t.Helper()
+	cfg := &config.Config{
+		SnapshotInterval: time.Hour,
+		Breaker:          config.BreakerConfig{FailureThreshold: 2, OpenTimeout: testOpenTimeout},
+	}
+	store, err := database.NewMemory(cfg)
+	if err != nil {
+		t.Fatalf("NewMemory() error: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	b := NewCircuitBreaker(cfg, store)
+
+	ctx := context.Background()
+	b.Record(ctx, instance, fasthttp.StatusInternalServerError, 0)
+	if !b.Record(ctx, instance, fasthttp.StatusInternalServerError, 0) {
+		t.Fatal("Record() did not trip at the failure threshold")
+	}
+	if !b.IsOpen(ctx, instance) {
+		t.Fatal("IsOpen() = false right after tripping")
+	}
+	time.Sleep(testOpenTimeout)
+	if state := b.State(ctx, instance); state != BREAKER_HALF_OPEN {
+		t.Fatalf("State() after OpenTimeout = %q, want %q", state, BREAKER_HALF_OPEN)
+	}
+	// A single caller gets the probe.
+	if b.IsOpen(ctx, instance) {
+		t.Fatal("IsOpen() = true for the first caller of a half-open breaker")
+	}
+	if !b.IsOpen(ctx, instance) {
+		t.Fatal("IsOpen() = false while the probe is out")
+	}
+	return b
+}
+
+func TestBreakerHalfOpenCloses(t *testing.T) {
+	ctx := context.Background()
+	instance := &config.Service{Name: "default", Table: "default"}
+	b := halfOpenBreaker(t, instance)
+
+	if b.Record(ctx, instance, fasthttp.StatusOK, time.Millisecond) {
+		t.Error("Record() of the probe success tripped the breaker")
+	}
+	if state := b.State(ctx, instance); state != BREAKER_CLOSED {
+		t.Errorf("State() after the probe success = %q, want %q", state, BREAKER_CLOSED)
+	}
+	if b.IsOpen(ctx, instance) {
+		t.Error("IsOpen() = true after the probe success")
+	}
+}
+
+func TestBreakerHalfOpenReopens(t *testing.T) {
+	ctx := context.Background()
+	instance := &config.Service{Name: "default", Table: "default"}
+	b := halfOpenBreaker(t, instance)
+
+	if !b.Record(ctx, instance, fasthttp.StatusInternalServerError, 0) {
+		t.Error("Record() of the probe failure did not trip the breaker")
+	}
+	if state := b.State(ctx, instance); state != BREAKER_OPEN {
+		t.Errorf("State() after the probe failure = %q, want %q", state, BREAKER_OPEN)
+	}
+	if !b.IsOpen(ctx, instance) {
+		t.Error("IsOpen() = false after the probe failure")
+	}
+}
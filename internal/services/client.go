@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"rinha-2025-go/internal/config"
 	"rinha-2025-go/pkg/http"
 	"time"
@@ -20,19 +21,27 @@ func NewHttpClient() *HttpClient {
 	}
 }
 
-func (c *HttpClient) Get(url string, instance *config.Service) (int, []byte, error) {
-	return c.makeRequest(fasthttp.MethodGet, url, nil, instance)
+func (c *HttpClient) Get(ctx context.Context, url string, instance *config.Service) (int, []byte, error) {
+	return c.makeRequest(ctx, fasthttp.MethodGet, url, nil, instance, "")
 }
 
-func (c *HttpClient) Post(url string, payload []byte, instance *config.Service) (int, error) {
-	status, _, err := c.makeRequest(fasthttp.MethodPost, url, payload, instance)
+// Post sends payload to url. A non-empty traceParent is forwarded in the
+// traceparent header.
+func (c *HttpClient) Post(ctx context.Context, url string, payload []byte, instance *config.Service, traceParent string) (int, error) {
+	status, _, err := c.makeRequest(ctx, fasthttp.MethodPost, url, payload, instance, traceParent)
 	if err != nil {
 		return 0, err
 	}
 	return status, nil
 }
 
-func (c *HttpClient) makeRequest(method string, url string, payload []byte, instance *config.Service) (int, []byte, error) {
+// makeRequest gives up at the processor timeout or at the ctx deadline,
+// whichever comes first. fasthttp cannot abort a request in flight, so a
+// cancelled ctx is only checked before sending.
+func (c *HttpClient) makeRequest(ctx context.Context, method string, url string, payload []byte, instance *config.Service, traceParent string) (int, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
 	req := fasthttp.AcquireRequest()
 	resp := fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseRequest(req)
@@ -40,14 +49,22 @@ func (c *HttpClient) makeRequest(method string, url string, payload []byte, inst
 	req.SetRequestURI(url)
 	req.Header.SetMethod(method)
 	req.Header.Set("X-Rinha-Token", instance.Token)
+	if traceParent != "" {
+		req.Header.Set("traceparent", traceParent)
+	}
 	if method == fasthttp.MethodPost {
 		req.Header.SetContentTypeBytes(headerContentTypeJSON)
 		req.SetBodyRaw(payload)
 	}
 	timeout := instance.Timeout + time.Duration(instance.MinResponseTime)*time.Millisecond
-	err := c.client.DoTimeout(req, resp, timeout)
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	err := c.client.DoDeadline(req, resp, deadline)
 	if err != nil {
 		return 0, nil, err
 	}
-	return resp.StatusCode(), resp.Body(), nil
+	// The response is released on return, so its body is copied.
+	return resp.StatusCode(), append([]byte(nil), resp.Body()...), nil
 }
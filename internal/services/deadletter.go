@@ -0,0 +1,64 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"rinha-2025-go/internal/models"
+	"time"
+)
+
+// deadLetterPayment parks a payment that will not be retried anymore.
+func (w *PaymentWorker) deadLetterPayment(ctx context.Context, payment *models.Payment, cause error) error {
+	entry := &models.DeadLetter{
+		Payment:        payment,
+		Reason:         cause.Error(),
+		Attempts:       payment.Attempts,
+		FirstAttemptAt: payment.Timestamp,
+		LastAttemptAt:  time.Now().UTC(),
+	}
+	var forwardErr *ForwardError
+	if errors.As(cause, &forwardErr) {
+		entry.StatusCode = forwardErr.StatusCode
+	}
+	if err := w.store.SaveDeadLetter(ctx, entry); err != nil {
+		return fmt.Errorf("failed to save dead letter: %w", err)
+	}
+	return nil
+}
+
+func (w *PaymentWorker) ListDeadLetters(ctx context.Context, offset, limit int64) ([]*models.DeadLetter, error) {
+	return w.store.ListDeadLetters(ctx, offset, limit)
+}
+
+func (w *PaymentWorker) GetDeadLetter(ctx context.Context, paymentID string) (*models.DeadLetter, error) {
+	return w.store.GetDeadLetter(ctx, paymentID)
+}
+
+// ReplayDeadLetter moves a dead letter back to the queue with a fresh attempt
+// count. It reports false if there was no such entry.
+func (w *PaymentWorker) ReplayDeadLetter(ctx context.Context, paymentID string) (bool, error) {
+	entry, err := w.store.GetDeadLetter(ctx, paymentID)
+	if err != nil || entry == nil {
+		return false, err
+	}
+	removed, err := w.store.RemoveDeadLetter(ctx, paymentID)
+	if err != nil || !removed {
+		return false, err
+	}
+	payment := entry.Payment
+	payment.Attempts = 0
+	if err := w.queue.Enqueue(ctx, payment); err != nil {
+		if err := w.store.SaveDeadLetter(ctx, entry); err != nil {
+			return false, fmt.Errorf("failed to restore dead letter: %w", err)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// DiscardDeadLetter drops a dead letter for good. It reports false if there
+// was no such entry.
+func (w *PaymentWorker) DiscardDeadLetter(ctx context.Context, paymentID string) (bool, error) {
+	return w.store.RemoveDeadLetter(ctx, paymentID)
+}
@@ -1,13 +1,14 @@
 package services
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"log/slog"
 	"os"
 	"rinha-2025-go/internal/config"
-	"rinha-2025-go/internal/database"
 	"rinha-2025-go/internal/models"
+	"rinha-2025-go/pkg/logging"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ohler55/ojg/oj"
@@ -15,143 +16,273 @@ import (
 )
 
 const (
-	HEALTH_REDIS_KEY       = "health"
-	HEALTH_REDIS_LOCK      = "health_lock"
-	HEALTH_REDIS_LOCK_TIME = "health_lock_time"
-	HEALTH_REDIS_INSTANCES = "instances"
+	HEALTH_LOCK      = "health_lock"
+	HEALTH_LOCK_TIME = "health_lock_time"
+	HEALTH_INSTANCES = "instances" // Health field of the active processor
 )
 
 type Health struct {
-	cfg      *config.Config
-	redis    *database.Redis
-	client   *HttpClient
-	services *config.Services
+	cfg     *config.Config
+	store   Store
+	client  *HttpClient
+	breaker *CircuitBreaker
+	router  Router
+	stats   *ForwardStats
+	queue   Queue
+	owner   string
+	done    chan struct{}
+	probe   atomic.Pointer[breakerProbe] // Trial forward this instance owes
+}
+
+// breakerProbe is a half-open processor whose probe token this instance
+// holds, until the token expires.
+type breakerProbe struct {
+	table string
+	until time.Time
 }
 
 func NewHealth(
 	config *config.Config,
-	redis *database.Redis,
+	store Store,
 	client *HttpClient,
+	queue Queue,
 ) *Health {
-	services := config.GetServices()
+	owner, _ := os.Hostname()
 	return &Health{
-		cfg:      config,
-		redis:    redis,
-		client:   client,
-		services: services,
+		cfg:     config,
+		store:   store,
+		client:  client,
+		breaker: NewCircuitBreaker(config, store),
+		router:  NewRouter(&config.Router),
+		stats:   NewForwardStats(store),
+		queue:   queue,
+		owner:   owner,
+		done:    make(chan struct{}),
+	}
+}
+
+// Shutdown stops ProcessServicesHealth and gives up the health lock if this
+// instance holds it, so another instance takes over the polling right away.
+func (h *Health) Shutdown(ctx context.Context) {
+	close(h.done)
+	if err := h.store.Unlock(ctx, HEALTH_LOCK, h.owner); err != nil {
+		slog.Error("release health lock failed", logging.Err(err))
 	}
 }
 
-func (h *Health) Close() {
-	h.redis.Close()
+// sleep waits for d and reports false once Shutdown was called or ctx is
+// done.
+func (h *Health) sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-h.done:
+		return false
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
 }
 
-func (h *Health) GetActiveInstance() *config.Service {
-	jsonData := h.redis.GetString(HEALTH_REDIS_KEY, HEALTH_REDIS_INSTANCES)
-	if jsonData == "" {
+// GetActiveInstance returns the processor selected by the instance holding
+// the health lock, as currently configured, or nil when none is.
+func (h *Health) GetActiveInstance(ctx context.Context) *config.Service {
+	table, err := h.store.GetHealth(ctx, HEALTH_INSTANCES)
+	if err != nil {
+		slog.Error("read active instance failed", logging.Err(err))
 		return nil
 	}
-	var activeService config.Service
-	if err := oj.Unmarshal([]byte(jsonData), &activeService); err != nil {
-		log.Print("GetActiveInstance:", err, jsonData)
+	if table == "" {
 		return nil
 	}
-	return &activeService
+	return h.cfg.GetServices().ByTable(table)
 }
 
-func (h *Health) setActiveInstance(activeService *config.Service) error {
-	bytes, err := oj.Marshal(activeService)
-	if err != nil {
-		log.Print("SetActiveInstance:", err, activeService)
-		return err
+// ProbeInstance returns, once, the half-open processor this instance must
+// send a trial forward to, or nil when it owes none.
+func (h *Health) ProbeInstance() *config.Service {
+	probe := h.probe.Swap(nil)
+	if probe == nil || time.Now().After(probe.until) {
+		return nil
 	}
-	return h.redis.SetString(HEALTH_REDIS_KEY, HEALTH_REDIS_INSTANCES, string(bytes))
+	return h.cfg.GetServices().ByTable(probe.table)
 }
 
-func (h *Health) selectActiveInstance() *config.Service {
-	d := &h.services.Default
-	f := &h.services.Fallback
-	if d.Failing {
-		if f.Failing {
-			return nil
-		}
-		return f
+// setActiveInstance stores only the table of the active processor, so the
+// URL, token and timeout come from the configuration of each instance and
+// follow a reload. An empty table means none.
+func (h *Health) setActiveInstance(ctx context.Context, activeService *config.Service) error {
+	var table string
+	if activeService != nil {
+		table = activeService.Table
+	}
+	return h.store.SetHealth(ctx, HEALTH_INSTANCES, table)
+}
+
+// selectActiveInstance lets the router pick the processor to use from the
+// last health report, the circuit breakers and the forward statistics.
+func (h *Health) selectActiveInstance(ctx context.Context, services *config.Services) *config.Service {
+	var candidates []RouteCandidate
+	for _, service := range services.All() {
+		candidates = append(candidates, h.routeCandidate(ctx, service))
 	}
-	if d.MinResponseTime <= 150 || f.Failing || d.MinResponseTime == f.MinResponseTime {
-		return d
+	return h.router.Select(candidates, h.queue.Length(ctx))
+}
+
+// routeCandidate keeps half-open processors out of the selection: routing
+// every payment to one would flood it. Instead, when this instance gets the
+// probe token, its next payment is the trial forward (see ProbeInstance).
+func (h *Health) routeCandidate(ctx context.Context, service *config.Service) RouteCandidate {
+	latency, failureRate := h.stats.Get(ctx, service.Table)
+	state := h.breaker.State(ctx, service)
+	if state == BREAKER_HALF_OPEN && !h.breaker.IsOpen(ctx, service) {
+		h.probe.Store(&breakerProbe{table: service.Table, until: time.Now().Add(h.cfg.Breaker.OpenTimeout)})
 	}
-	if f.MinResponseTime <= 150 {
-		return f
+	return RouteCandidate{
+		Service:     service,
+		BreakerOpen: state != BREAKER_CLOSED,
+		Latency:     latency,
+		FailureRate: failureRate,
 	}
-	return d
 }
 
-func (h *Health) refreshServiceStatus() {
+// applySelection stores the processor chosen for services as the active one
+// and logs the switch, if any.
+func (h *Health) applySelection(ctx context.Context, services *config.Services) {
 	start := time.Now()
-	currentActive := h.GetActiveInstance()
-	h.updateServicesHealth(h.services)
-	activeStatus := h.selectActiveInstance()
-	h.setActiveInstance(activeStatus)
-	from, to := "nil", "nil"
+	currentActive := h.GetActiveInstance(ctx)
+	activeStatus := h.selectActiveInstance(ctx, services)
+	h.setActiveInstance(ctx, activeStatus)
+	from, to := "none", "none"
 	if currentActive != nil {
-		from = fmt.Sprintf("[%s %d]", currentActive.Table, currentActive.MinResponseTime)
+		from = currentActive.Name
 	}
+	var minResponseTime uint32
 	if activeStatus != nil {
-		to = fmt.Sprintf("[%s %d]", activeStatus.Table, activeStatus.MinResponseTime)
+		to = activeStatus.Name
+		minResponseTime = activeStatus.MinResponseTime
 	}
 	if from == to {
 		return
 	}
-	log.Println(from, "->", to)
-	log.Println("refreshServiceStatus:", time.Since(start))
+	activeSwitches.With(to).Inc()
+	slog.Info("active processor switched", "router", h.router.Name(), "from", from, "to", to,
+		"minResponseTime", minResponseTime, "elapsed", time.Since(start))
+}
+
+func (h *Health) refreshServiceStatus(ctx context.Context) {
+	services := h.cfg.GetServices()
+	h.updateServicesHealth(ctx, services)
+	h.saveServicesHealth(ctx, services)
+	h.applySelection(ctx, services)
+}
+
+// RecordForward feeds a forward outcome to the statistics used by the router
+// and to the processor circuit breaker.
+// When it trips, the active instance is selected again right away from the
+// last shared health report instead of waiting for the next poll.
+func (h *Health) RecordForward(ctx context.Context, instance *config.Service, status int, elapsed time.Duration) {
+	h.stats.Record(instance.Table, forwardSucceeded(status), elapsed)
+	if !h.breaker.Record(ctx, instance, status, elapsed) {
+		return
+	}
+	slog.Warn("circuit breaker opened", logging.KeyProcessor, instance.Name)
+	h.stats.Flush(ctx)
+	services := h.cfg.GetServices().Clone()
+	h.loadServicesHealth(ctx, services)
+	h.applySelection(ctx, services)
+}
+
+func (h *Health) saveServicesHealth(ctx context.Context, services *config.Services) {
+	for _, service := range services.All() {
+		report := models.HealthResponse{Failing: service.Failing, MinResponseTime: service.MinResponseTime}
+		bytes, err := oj.Marshal(&report)
+		if err != nil {
+			slog.Error("encode health report failed", logging.KeyProcessor, service.Name, logging.Err(err))
+			continue
+		}
+		if err := h.store.SetHealth(ctx, service.Table, string(bytes)); err != nil {
+			slog.Error("save health report failed", logging.KeyProcessor, service.Name, logging.Err(err))
+		}
+	}
+}
+
+func (h *Health) loadServicesHealth(ctx context.Context, services *config.Services) {
+	for _, service := range services.All() {
+		jsonData, err := h.store.GetHealth(ctx, service.Table)
+		if err != nil {
+			slog.Error("read health report failed", logging.KeyProcessor, service.Name, logging.Err(err))
+			continue
+		}
+		if jsonData == "" {
+			continue
+		}
+		var report models.HealthResponse
+		if err := oj.Unmarshal([]byte(jsonData), &report); err != nil {
+			slog.Error("decode health report failed", logging.KeyProcessor, service.Name,
+				"data", jsonData, logging.Err(err))
+			continue
+		}
+		service.Failing = report.Failing
+		service.MinResponseTime = report.MinResponseTime
+	}
 }
 
-func (h *Health) updateServicesHealth(services *config.Services) {
+func (h *Health) updateServicesHealth(ctx context.Context, services *config.Services) {
 	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		health := h.getServiceHealth(&services.Default)
-		services.Default.Failing = health.Failing
-		services.Default.MinResponseTime = health.MinResponseTime
-	}()
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		health := h.getServiceHealth(&services.Fallback)
-		services.Fallback.Failing = health.Failing
-		services.Fallback.MinResponseTime = health.MinResponseTime
-	}()
+	for _, service := range services.All() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			health := h.getServiceHealth(ctx, service)
+			service.Failing = health.Failing
+			service.MinResponseTime = health.MinResponseTime
+		}()
+	}
 	wg.Wait()
 }
 
-func (h *Health) getServiceHealth(service *config.Service) *models.HealthResponse {
+func (h *Health) getServiceHealth(ctx context.Context, service *config.Service) *models.HealthResponse {
 	health := models.HealthResponse{Failing: true}
-	statusCode, body, err := h.client.Get(service.URL+"/payments/service-health", service)
+	statusCode, body, err := h.client.Get(ctx, service.URL+"/payments/service-health", service)
 	if err != nil {
-		log.Print("getServiceHealth:Get:", service.URL, err)
+		slog.Warn("health check failed", logging.KeyProcessor, service.Name, logging.Err(err))
 		return &health
 	}
 	if statusCode == fasthttp.StatusOK {
 		if err := oj.Unmarshal(body, &health); err != nil {
 			health.Failing = true
-			log.Print("getServiceHealth:Unmarshal:", service.URL, err)
+			slog.Warn("decode health check failed", logging.KeyProcessor, service.Name, logging.Err(err))
 		}
 	}
 	return &health
 }
 
-func (h *Health) ProcessServicesHealth() {
-	lockValue, _ := os.Hostname()
-	lockTTL := time.Second + h.cfg.ServiceRefreshInterval
+// ProcessForwardStats shares the forward statistics of this instance every
+// STATS_FLUSH until Shutdown.
+func (h *Health) ProcessForwardStats(ctx context.Context) {
+	for h.sleep(ctx, STATS_FLUSH) {
+		h.stats.Flush(ctx)
+	}
+}
 
-	time.Sleep(100 * time.Millisecond)
+func (h *Health) ProcessServicesHealth(ctx context.Context) {
+	if !h.sleep(ctx, 100*time.Millisecond) {
+		return
+	}
 
 	backoff := time.Second
 	for {
-		waitTime := h.cfg.ServiceRefreshInterval
-		if !h.redis.TryLock(HEALTH_REDIS_LOCK, lockValue, lockTTL) {
-			time.Sleep(backoff)
+		interval := h.cfg.GetServiceRefreshInterval()
+		lockTTL := time.Second + interval
+		waitTime := interval
+		locked, err := h.store.TryLock(ctx, HEALTH_LOCK, h.owner, lockTTL)
+		if err != nil {
+			slog.Error("acquire health lock failed", logging.Err(err))
+		}
+		if !locked {
+			if !h.sleep(ctx, backoff) {
+				return
+			}
 			if backoff < 30*time.Second {
 				backoff *= 2
 			}
@@ -159,18 +290,20 @@ func (h *Health) ProcessServicesHealth() {
 		}
 		backoff = time.Second
 
-		lastRun, err := h.redis.GetLastRunTime(HEALTH_REDIS_LOCK_TIME)
+		lastRun, err := h.store.GetLastRunTime(ctx, HEALTH_LOCK_TIME)
 		if err == nil {
-			waitTime = h.cfg.ServiceRefreshInterval - time.Since(lastRun)
+			waitTime = interval - time.Since(lastRun)
 			if waitTime < 0 {
-				h.refreshServiceStatus()
-				h.redis.SetLastRunTime(HEALTH_REDIS_LOCK_TIME, time.Now())
-				waitTime = h.cfg.ServiceRefreshInterval
+				h.refreshServiceStatus(ctx)
+				h.store.SetLastRunTime(ctx, HEALTH_LOCK_TIME, time.Now())
+				waitTime = interval
 			}
 		} else {
-			log.Println("ProcessServicesHealth:GetLastRunTime:", err)
+			slog.Error("read last health check time failed", logging.Err(err))
+		}
+		h.store.Unlock(ctx, HEALTH_LOCK, h.owner)
+		if !h.sleep(ctx, waitTime) {
+			return
 		}
-		h.redis.Unlock(HEALTH_REDIS_LOCK)
-		time.Sleep(waitTime)
 	}
 }
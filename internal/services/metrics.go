@@ -0,0 +1,32 @@
+package services
+
+import (
+	"rinha-2025-go/pkg/metrics"
+)
+
+var (
+	forwardDuration = metrics.NewHistogramVec("processor_forward_duration_seconds",
+		"Latency of payments forwarded to each processor.", metrics.DefBuckets, "processor")
+	forwardTotal = metrics.NewCounterVec("processor_forward_total",
+		"Payments forwarded to each processor by response status (0 when no response).", "processor", "code")
+	activeSwitches = metrics.NewCounterVec("active_instance_switches_total",
+		"Changes of the active processor, by the processor switched to.", "to")
+)
+
+// registerQueueMetrics exposes the backlog of the worker at scrape time.
+func (w *PaymentWorker) registerQueueMetrics() {
+	metrics.NewGaugeFunc("payment_queue_depth", "Payments waiting in the shared queue.",
+		func() float64 { return float64(w.queue.Length(w.ctx)) })
+	metrics.NewGaugeFunc("payment_channel_length", "Payments buffered in this instance.",
+		func() float64 { return float64(len(w.paymentChan)) })
+	metrics.NewGaugeFunc("payment_channel_capacity", "Capacity of the in-memory payment buffer.",
+		func() float64 { return float64(cap(w.paymentChan)) })
+	metrics.NewGaugeFunc("payment_workers", "ProcessQueue goroutines running in this instance.",
+		func() float64 { return float64(w.Workers()) })
+	metrics.NewGaugeFunc("payment_workers_busy", "ProcessQueue goroutines handling a payment.",
+		func() float64 { return float64(w.busy.Load()) })
+	if w.wal != nil {
+		metrics.NewGaugeFunc("wal_pending_payments", "Payments held in the write-ahead log of this instance.",
+			func() float64 { return float64(w.wal.Pending()) })
+	}
+}
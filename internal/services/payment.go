@@ -2,13 +2,18 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"os"
 	"rinha-2025-go/internal/config"
-	"rinha-2025-go/internal/database"
 	"rinha-2025-go/internal/models"
-	"strconv"
+	"rinha-2025-go/pkg/logging"
+	"rinha-2025-go/pkg/metrics"
+	"rinha-2025-go/pkg/tracing"
+	"rinha-2025-go/pkg/wal"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ohler55/ojg/oj"
@@ -23,166 +28,755 @@ var BufferPool = sync.Pool{
 	},
 }
 
+// ErrPaymentBusy is returned by ProcessPayment when another worker holds the
+// forwarding lease of the payment.
+var ErrPaymentBusy = errors.New("payment is being forwarded by another worker")
+
+// PAYMENT_BUSY_DELAY is how long a payment found busy waits before it is
+// looked at again.
+const PAYMENT_BUSY_DELAY = time.Second
+
+// ForwardError is returned when a processor did not accept a payment.
+// StatusCode is zero when no response was received.
+type ForwardError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *ForwardError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("forward failed: %v", e.Err)
+	}
+	return fmt.Sprintf("invalid status code: %d", e.StatusCode)
+}
+
+func (e *ForwardError) Unwrap() error {
+	return e.Err
+}
+
 type PaymentWorker struct {
 	ctx         context.Context
 	config      *config.Config
-	queue       *PaymentQueue
+	queue       Queue
 	client      *HttpClient
-	redis       *database.Redis
+	store       Store
 	health      *Health
+	wal         *wal.Log // nil when the write-ahead log is disabled
+	owner       string
 	paymentChan chan *models.Payment
+	waiters     sync.Map // correlationId -> chan *models.PaymentResult, see WaitPayment
+
+	mu    sync.Mutex
+	stops []chan struct{} // One per running ProcessQueue goroutine
+	busy  atomic.Int64    // ProcessQueue goroutines handling a payment
+
+	done    chan struct{}  // Closed by Shutdown
+	loops   sync.WaitGroup // Goroutines started by Start
+	running sync.WaitGroup // ProcessQueue goroutines
+	submits sync.WaitGroup // Pending SubmitPayment calls
 }
 
+// NewPaymentWorker creates a worker whose background goroutines run under
+// ctx, the root context cancelled once shutdown is over. Accepted payments
+// are written to log first, unless it is nil.
 func NewPaymentWorker(
+	ctx context.Context,
 	cfg *config.Config,
-	redis *database.Redis,
+	store Store,
 	client *HttpClient,
 	health *Health,
+	queue Queue,
+	log *wal.Log,
 ) *PaymentWorker {
-	ctx := context.Background()
-	return &PaymentWorker{
+	owner, _ := os.Hostname()
+	w := &PaymentWorker{
 		ctx:         ctx,
 		config:      cfg,
-		queue:       NewPaymentQueue(ctx, redis),
+		queue:       queue,
 		client:      client,
-		redis:       redis,
+		store:       store,
 		health:      health,
+		wal:         log,
+		owner:       owner,
 		paymentChan: make(chan *models.Payment, 1000),
+		done:        make(chan struct{}),
 	}
+	w.registerQueueMetrics()
+	return w
 }
 
 func (w *PaymentWorker) Close() {
 	w.queue.Close()
 }
 
-func (w *PaymentWorker) EnqueuePayment(payment *models.Payment) {
+// AcceptPayment registers the correlationId of an incoming payment and
+// reports false for duplicates, which must not be enqueued again. The
+// payment is in the write-ahead log, if enabled, once it returns true.
+// With the log, a store failure does not reject the payment: duplicates
+// are then only caught by BeginPayment, before they are forwarded.
+func (w *PaymentWorker) AcceptPayment(ctx context.Context, payment *models.Payment) (bool, error) {
+	if err := w.logPayment(payment); err != nil {
+		return false, err
+	}
+	accepted, err := w.store.AcceptPayment(ctx, payment.PaymentID, w.config.IdempotencyTTL)
+	if err != nil && payment.LogSeq != 0 {
+		slog.Warn("register payment failed, accepted from the write-ahead log",
+			logging.KeyCorrelationID, payment.PaymentID, logging.Err(err))
+		return true, nil
+	}
+	if err != nil || !accepted {
+		w.releasePayment(payment, true)
+	}
+	return accepted, err
+}
+
+func (w *PaymentWorker) logPayment(payment *models.Payment) error {
+	if w.wal == nil {
+		return nil
+	}
+	data, err := oj.Marshal(payment)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payment: %w", err)
+	}
+	seq, err := w.wal.Append(data)
+	if err != nil {
+		return fmt.Errorf("failed to log payment: %w", err)
+	}
+	payment.LogSeq = seq
+	return nil
+}
+
+// releasePayment drops the write-ahead log record of payment once it is
+// safe elsewhere: done with (final), or handed to a durable queue.
+func (w *PaymentWorker) releasePayment(payment *models.Payment, final bool) {
+	if payment.LogSeq == 0 || !(final || w.queue.Durable()) {
+		return
+	}
+	if err := w.wal.Ack(payment.LogSeq); err != nil {
+		slog.Error("release logged payment failed", logging.KeyCorrelationID, payment.PaymentID, logging.Err(err))
+		return
+	}
+	payment.LogSeq = 0
+}
+
+// Replay enqueues the payments the write-ahead log still held at startup:
+// accepted by the previous run but never handed over or finished.
+func (w *PaymentWorker) Replay(records []wal.Record) {
+	for _, record := range records {
+		var payment models.Payment
+		if err := oj.Unmarshal(record.Data, &payment); err != nil {
+			slog.Error("decode logged payment failed", "seq", record.Seq, logging.Err(err))
+			w.wal.Ack(record.Seq)
+			continue
+		}
+		payment.LogSeq = record.Seq
+		w.EnqueuePayment(w.ctx, &payment)
+	}
+	if len(records) > 0 {
+		slog.Info("logged payments replayed", "count", len(records))
+	}
+}
+
+// SubmitPayment enqueues payment in the background, outside of the request
+// that accepted it. Shutdown waits for submitted payments to be enqueued.
+func (w *PaymentWorker) SubmitPayment(payment *models.Payment) {
+	w.submits.Add(1)
+	go func() {
+		defer w.submits.Done()
+		w.EnqueuePayment(w.ctx, payment)
+	}()
+}
+
+func (w *PaymentWorker) EnqueuePayment(ctx context.Context, payment *models.Payment) {
+	span := tracing.StartFrom("EnqueuePayment", tracing.KindProducer, payment.TraceParent)
+	defer span.End()
 	select {
 	case w.paymentChan <- payment:
+		span.SetString("queue", "channel")
 	default:
-		w.queue.Enqueue(payment)
+		span.SetString("queue", "shared")
+		if err := w.queue.Enqueue(ctx, payment); err != nil {
+			span.SetError(err)
+			slog.Warn("enqueue payment failed, waiting for a local worker",
+				logging.KeyCorrelationID, payment.PaymentID, logging.Err(err))
+			// Workers keep draining paymentChan until Shutdown has waited
+			// for the submitted payments, so this only gives up once ctx
+			// is done.
+			select {
+			case w.paymentChan <- payment:
+			case <-ctx.Done():
+				// Lost unless the write-ahead log replays it on the next start.
+				slog.Error("enqueue payment failed", logging.KeyCorrelationID, payment.PaymentID, logging.Err(ctx.Err()))
+			}
+			return
+		}
+		w.releasePayment(payment, false)
 	}
 }
 
-func (w *PaymentWorker) ProcessQueue() {
-	for payment := range w.paymentChan {
-		if err := w.ProcessPayment(payment); err != nil {
-			w.queue.Enqueue(payment)
+// SetWorkers starts or stops ProcessQueue goroutines until n are running.
+// A stopped worker finishes the payment it holds before exiting.
+func (w *PaymentWorker) SetWorkers(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopping(w.ctx) {
+		n = 0
+	}
+	for len(w.stops) < n {
+		stop := make(chan struct{})
+		w.stops = append(w.stops, stop)
+		w.running.Add(1)
+		go func() {
+			defer w.running.Done()
+			w.ProcessQueue(w.ctx, stop)
+		}()
+	}
+	for len(w.stops) > n {
+		last := len(w.stops) - 1
+		close(w.stops[last])
+		w.stops = w.stops[:last]
+	}
+}
+
+// Workers returns the number of ProcessQueue goroutines running.
+func (w *PaymentWorker) Workers() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.stops)
+}
+
+func (w *PaymentWorker) ProcessQueue(ctx context.Context, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case payment := <-w.paymentChan:
+			w.handlePayment(ctx, payment)
 		}
 	}
 }
 
-func (w *PaymentWorker) getCurrentInstance() *config.Service {
+func (w *PaymentWorker) handlePayment(ctx context.Context, payment *models.Payment) {
+	w.busy.Add(1)
+	defer w.busy.Add(-1)
+	// An attempt must not outlive the lease BeginPayment takes on the payment.
+	attemptCtx, cancel := context.WithTimeout(ctx, w.config.QueueVisibilityTimeout)
+	err := w.ProcessPayment(attemptCtx, payment)
+	cancel()
+	if errors.Is(err, ErrPaymentBusy) {
+		w.deferPayment(ctx, payment)
+		return
+	}
+	if err != nil {
+		slog.Debug("payment attempt failed", logging.KeyCorrelationID, payment.PaymentID,
+			"attempts", payment.Attempts, logging.Err(err))
+		if err := w.retryPayment(ctx, payment, err); err != nil {
+			// Leave it pending so Reclaim delivers it again.
+			slog.Error("retry payment failed", logging.KeyCorrelationID, payment.PaymentID, logging.Err(err))
+			return
+		}
+	} else {
+		w.releasePayment(payment, true)
+		w.notifyWaiter(payment, models.PAYMENT_RESULT_PROCESSED, "")
+	}
+	if err := w.queue.Ack(ctx, payment); err != nil {
+		slog.Error("ack payment failed", logging.KeyCorrelationID, payment.PaymentID, logging.Err(err))
+	}
+}
+
+// deferPayment puts back a payment whose lease another worker holds, to be
+// looked at again once that worker is likely done with it. The copy is kept
+// until then, as the lease holder may still fail or die. A payment handed
+// over by WaitPayment stays on this instance, so that the wait gets the
+// outcome of the lease holder.
+func (w *PaymentWorker) deferPayment(ctx context.Context, payment *models.Payment) {
+	if _, waiting := w.waiters.Load(payment.PaymentID); waiting && payment.QueueID == "" {
+		w.submits.Add(1)
+		time.AfterFunc(PAYMENT_BUSY_DELAY, func() {
+			defer w.submits.Done()
+			w.EnqueuePayment(w.ctx, payment)
+		})
+		return
+	}
+	if err := w.queue.EnqueueDelayed(ctx, payment, PAYMENT_BUSY_DELAY); err != nil {
+		// Leave it pending so Reclaim delivers it again.
+		slog.Error("defer payment failed", logging.KeyCorrelationID, payment.PaymentID, logging.Err(err))
+		return
+	}
+	w.releasePayment(payment, false)
+	if err := w.queue.Ack(ctx, payment); err != nil {
+		slog.Error("ack payment failed", logging.KeyCorrelationID, payment.PaymentID, logging.Err(err))
+	}
+}
+
+// retryPayment schedules a failed payment for a later attempt following the
+// retry policy, or dead-letters it when the policy gives up on it.
+func (w *PaymentWorker) retryPayment(ctx context.Context, payment *models.Payment, cause error) error {
+	status := -1
+	var forwardErr *ForwardError
+	if errors.As(cause, &forwardErr) {
+		status = forwardErr.StatusCode
+	}
+	delay, ok := retryDelay(&w.config.Retry, status, payment.Attempts)
+	if !ok {
+		slog.Warn("payment dead-lettered", logging.KeyCorrelationID, payment.PaymentID,
+			"attempts", payment.Attempts, "status", status, logging.Err(cause))
+		if err := w.deadLetterPayment(ctx, payment, cause); err != nil {
+			return err
+		}
+		w.releasePayment(payment, true)
+		w.notifyWaiter(payment, models.PAYMENT_RESULT_FAILED, cause.Error())
+		return nil
+	}
+	slog.Debug("payment retry scheduled", logging.KeyCorrelationID, payment.PaymentID, "delay", delay)
+	if err := w.queue.EnqueueDelayed(ctx, payment, delay); err != nil {
+		return err
+	}
+	w.releasePayment(payment, false)
+	return nil
+}
+
+// Start runs the background loops of the worker: consumers ProcessSharedQueue
+// goroutines, ProcessDelayedQueue, ProcessQueueRecovery and, when enabled,
+// ProcessReconciliation.
+func (w *PaymentWorker) Start(ctx context.Context, consumers int) {
+	for range consumers {
+		w.goLoop(ctx, w.ProcessSharedQueue)
+	}
+	w.goLoop(ctx, w.ProcessDelayedQueue)
+	w.goLoop(ctx, w.ProcessQueueRecovery)
+	if w.config.Reconcile.Interval > 0 {
+		w.goLoop(ctx, w.ProcessReconciliation)
+	}
+}
+
+func (w *PaymentWorker) goLoop(ctx context.Context, loop func(context.Context)) {
+	w.loops.Add(1)
+	go func() {
+		defer w.loops.Done()
+		loop(ctx)
+	}()
+}
+
+// Shutdown stops the worker once the server no longer accepts payments.
+// Queue consumption stops first, then payments still buffered in memory are
+// put back in the shared queue and the workers finish the payment they hold.
+// If ctx expires first, payments still being forwarded are left pending and
+// recovered by the other instances after the visibility timeout.
+func (w *PaymentWorker) Shutdown(ctx context.Context) error {
+	close(w.done)
+	if err := waitGroup(ctx, &w.loops); err != nil {
+		return fmt.Errorf("queue consumers did not stop: %w", err)
+	}
+	if err := waitGroup(ctx, &w.submits); err != nil {
+		return fmt.Errorf("submitted payments not enqueued: %w", err)
+	}
+	w.SetWorkers(0)
+	requeued := 0
+	for drained := false; !drained; {
+		select {
+		case payment := <-w.paymentChan:
+			if err := w.queue.Requeue(ctx, payment); err != nil {
+				slog.Error("requeue payment failed", logging.KeyCorrelationID, payment.PaymentID, logging.Err(err))
+				continue
+			}
+			w.releasePayment(payment, false)
+			requeued++
+		default:
+			drained = true
+		}
+	}
+	slog.Info("buffered payments requeued", "count", requeued)
+	if err := waitGroup(ctx, &w.running); err != nil {
+		return fmt.Errorf("in-flight payments did not finish: %w", err)
+	}
+	return nil
+}
+
+// stopping reports whether Shutdown was called or ctx is done.
+func (w *PaymentWorker) stopping(ctx context.Context) bool {
+	select {
+	case <-w.done:
+		return true
+	case <-ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d and reports false once Shutdown was called or ctx is
+// done.
+func (w *PaymentWorker) sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-w.done:
+		return false
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ProcessSharedQueue drains the shared queue back into paymentChan. Payments
+// are only pulled while the channel is below its high-water mark, so a busy
+// instance leaves the backlog in the queue for the other instances.
+func (w *PaymentWorker) ProcessSharedQueue(ctx context.Context) {
+	highWater := cap(w.paymentChan) / 2
+	for !w.stopping(ctx) {
+		if len(w.paymentChan) >= highWater {
+			w.sleep(ctx, 10*time.Millisecond)
+			continue
+		}
+		payment, err := w.queue.Dequeue(ctx)
+		if err != nil {
+			slog.Error("dequeue payment failed", logging.Err(err))
+			w.sleep(ctx, time.Second)
+			continue
+		}
+		if payment == nil {
+			continue
+		}
+		select {
+		case w.paymentChan <- payment:
+		case <-w.done:
+			w.requeueDequeued(ctx, payment)
+			return
+		case <-ctx.Done():
+			w.requeueDequeued(ctx, payment)
+			return
+		}
+	}
+}
+
+// requeueDequeued puts back a payment ProcessSharedQueue took but could not
+// buffer before stopping. If that fails it stays pending, when the queue
+// supports it, until another instance reclaims it.
+func (w *PaymentWorker) requeueDequeued(ctx context.Context, payment *models.Payment) {
+	if err := w.queue.Requeue(context.WithoutCancel(ctx), payment); err != nil {
+		slog.Error("requeue payment failed", logging.KeyCorrelationID, payment.PaymentID, logging.Err(err))
+	}
+}
+
+// ProcessDelayedQueue moves payments whose retry delay has elapsed back into
+// the queue.
+func (w *PaymentWorker) ProcessDelayedQueue(ctx context.Context) {
+	for !w.stopping(ctx) {
+		count, err := w.queue.PromoteDue(ctx, 100)
+		if err != nil {
+			slog.Error("promote delayed payments failed", logging.Err(err))
+			w.sleep(ctx, time.Second)
+			continue
+		}
+		if count == 0 {
+			w.sleep(ctx, 100*time.Millisecond)
+		}
+	}
+}
+
+// ProcessQueueRecovery periodically re-queues payments held by instances
+// that died before acknowledging them.
+func (w *PaymentWorker) ProcessQueueRecovery(ctx context.Context) {
+	interval := w.config.QueueVisibilityTimeout / 2
+	for w.sleep(ctx, interval) {
+		count, err := w.queue.Reclaim(ctx)
+		if err != nil {
+			slog.Error("reclaim payments failed", logging.Err(err))
+		}
+		if count > 0 {
+			slog.Info("abandoned payments requeued", "count", count)
+		}
+	}
+}
+
+// getCurrentInstance waits for an active processor. It returns nil when ctx
+// is done first.
+func (w *PaymentWorker) getCurrentInstance(ctx context.Context) *config.Service {
 	for {
-		if instance := w.health.GetActiveInstance(); instance != nil {
+		if instance := w.health.GetActiveInstance(ctx); instance != nil {
 			return instance
 		}
-		time.Sleep(10 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(10 * time.Millisecond):
+		}
 	}
 }
 
-func (w *PaymentWorker) ProcessPayment(payment *models.Payment) error {
-	activeInstance := w.getCurrentInstance()
-	payment.Timestamp = time.Now().UTC()
+// ProcessPayment forwards a payment to the active processor and records it.
+// Its trace span is a child of the intake request, also across the queue.
+func (w *PaymentWorker) ProcessPayment(ctx context.Context, payment *models.Payment) error {
+	span := tracing.StartFrom("ProcessPayment", tracing.KindConsumer, payment.TraceParent)
+	span.SetString("payment.id", payment.PaymentID)
+	err := w.processPayment(ctx, payment, span.Context())
+	span.SetInt("payment.attempts", int64(payment.Attempts))
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+func (w *PaymentWorker) processPayment(ctx context.Context, payment *models.Payment, trace tracing.SpanContext) error {
+	state, pinned, err := w.store.BeginPayment(ctx, payment.PaymentID, w.owner,
+		w.config.QueueVisibilityTimeout, w.config.IdempotencyTTL)
+	if err != nil {
+		return fmt.Errorf("failed to begin payment: %w", err)
+	}
+	switch state {
+	case models.PAYMENT_STATE_DONE:
+		// Forwarded before, by this copy or another one.
+		if instance := w.config.GetServices().ByTable(pinned); instance != nil {
+			payment.Processor = instance.Name
+		}
+		return nil
+	case models.PAYMENT_STATE_BUSY:
+		return ErrPaymentBusy
+	}
+	// The lease is given back even when ctx has expired.
+	record := context.WithoutCancel(ctx)
+
+	activeInstance := w.config.GetServices().ByTable(pinned)
+	if activeInstance == nil {
+		activeInstance = w.health.ProbeInstance()
+	}
+	if activeInstance == nil {
+		activeInstance = w.getCurrentInstance(ctx)
+	}
+	if activeInstance == nil {
+		w.store.ReleasePayment(record, payment.PaymentID)
+		return fmt.Errorf("no processor available: %w", ctx.Err())
+	}
+	if payment.Timestamp.IsZero() {
+		// Millisecond precision, as the processors report it, so summary
+		// windows mean the same on both sides.
+		payment.Timestamp = time.Now().UTC().Truncate(time.Millisecond)
+	}
 
 	// Get buffer from pool for JSON marshaling
 	bufPtr := BufferPool.Get().(*[]byte)
 	defer BufferPool.Put(bufPtr)
 
-	payload, err := oj.Marshal(payment, *bufPtr)
+	request := models.PaymentRequest{
+		PaymentID: payment.PaymentID,
+		Amount:    payment.Amount,
+		Timestamp: payment.Timestamp,
+	}
+	payload, err := oj.Marshal(&request, *bufPtr)
 	if err != nil {
+		w.store.ReleasePayment(record, payment.PaymentID)
 		return fmt.Errorf("failed to marshal payment: %w", err)
 	}
 
-	return w.forwardPayment(activeInstance, payment, payload)
+	payment.Attempts++
+	if err := w.forwardPayment(ctx, activeInstance, payment, payload, pinned != "", trace); err != nil {
+		w.store.ReleasePayment(record, payment.PaymentID)
+		return err
+	}
+	payment.Processor = activeInstance.Name
+	if err := w.store.CompletePayment(record, payment.PaymentID, activeInstance.Table); err != nil {
+		slog.Error("complete payment failed", logging.KeyCorrelationID, payment.PaymentID, logging.Err(err))
+	}
+	return nil
 }
 
-func (w *PaymentWorker) forwardPayment(instance *config.Service, payment *models.Payment, payload []byte) error {
-	status, err := w.client.Post(instance.URL+"/payments", payload, instance)
+// forwardPayment sends the payment to the processor and records it. The
+// processor rejects a correlationId it has already seen with a 422, so when
+// a previous attempt against the same processor ended without a clear answer
+// (pinned), a 422 means the payment went through and only needs recording.
+func (w *PaymentWorker) forwardPayment(ctx context.Context, instance *config.Service, payment *models.Payment, payload []byte, pinned bool, trace tracing.SpanContext) error {
+	span := tracing.Start("HttpClient.Post", tracing.KindClient, trace)
+	span.SetString("processor", instance.Name)
+	start := time.Now()
+	status, err := w.client.Post(ctx, instance.URL+"/payments", payload, instance, span.TraceParent())
+	elapsed := time.Since(start)
+	span.SetInt("http.status_code", int64(status))
+	span.SetError(err)
+	span.End()
+	forwardDuration.With(instance.Name).ObserveDuration(elapsed)
+	forwardTotal.With(instance.Name, metrics.StatusLabel(status)).Inc()
+	// Whatever the processor answered has to be recorded, even when ctx
+	// expired meanwhile.
+	ctx = context.WithoutCancel(ctx)
+	w.health.RecordForward(ctx, instance, status, elapsed)
+	slog.Debug("payment forwarded", logging.KeyCorrelationID, payment.PaymentID, logging.KeyProcessor, instance.Name,
+		"status", status, "elapsed", elapsed)
 	if err != nil || status < fasthttp.StatusOK || status >= fasthttp.StatusMultipleChoices {
 		if status == fasthttp.StatusUnprocessableEntity {
-			return nil
+			if pinned {
+				return w.savePayment(ctx, instance, payment, trace)
+			}
+			return &ForwardError{StatusCode: status}
 		}
-		if status == 0 || status == fasthttp.StatusInternalServerError {
-			time.Sleep(time.Second)
+		if status == 0 {
+			// The request may have reached the processor; retry on it only.
+			if err := w.store.PinPayment(ctx, payment.PaymentID, instance.Table); err != nil {
+				slog.Error("pin payment failed", logging.KeyCorrelationID, payment.PaymentID, logging.Err(err))
+			}
 		}
-		return fmt.Errorf("invalid status code: %d", status)
+		return &ForwardError{StatusCode: status, Err: err}
 	}
-	if err := w.redis.SavePayment(instance, payment); err != nil {
+	return w.savePayment(ctx, instance, payment, trace)
+}
+
+func (w *PaymentWorker) savePayment(ctx context.Context, instance *config.Service, payment *models.Payment, trace tracing.SpanContext) error {
+	span := tracing.Start("Store.SavePayment", tracing.KindClient, trace)
+	err := w.store.SavePayment(ctx, instance, payment)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		// The processor has it: the retry must hit the same one and save on 422.
+		if err := w.store.PinPayment(ctx, payment.PaymentID, instance.Table); err != nil {
+			slog.Error("pin payment failed", logging.KeyCorrelationID, payment.PaymentID, logging.Err(err))
+		}
 		return fmt.Errorf("failed to save payment: %w", err)
 	}
 	return nil
 }
 
-func (w *PaymentWorker) GetSummary(from, to string) (*models.SummaryResponse, error) {
+func (w *PaymentWorker) GetSummary(ctx context.Context, from, to string) (models.SummaryResponse, error) {
 	param, err := processSummaryParam(from, to)
 	if err != nil {
 		return nil, err
 	}
-	services := w.config.GetServices()
-	var res models.SummaryResponse
+	processors := w.config.GetServices().All()
+	summaries, err := w.summarize(ctx, processors, param)
+	if err != nil {
+		return nil, err
+	}
+	res := make(models.SummaryResponse, len(processors))
+	for i, processor := range processors {
+		res[processor.Name] = summaries[i]
+	}
+	return res, nil
+}
+
+// summarize reads the summary of each processor concurrently. The caller
+// passes the processors, so that it uses the same ones if the configuration
+// is reloaded meanwhile.
+func (w *PaymentWorker) summarize(ctx context.Context, processors []*config.Service, param *models.SummaryParam) ([]*models.ProcessorSummary, error) {
+	summaries := make([]*models.ProcessorSummary, len(processors))
+	errs := make([]error, len(processors))
 	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		res.Default = w.redis.GetSummary(&services.Default, param)
-	}()
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		res.Fallback = w.redis.GetSummary(&services.Fallback, param)
-	}()
+	for i, processor := range processors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			summaries[i], errs[i] = w.store.GetSummary(ctx, processor, param)
+		}()
+	}
 	wg.Wait()
-	return &res, nil
+	for i, processor := range processors {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("failed to read %s summary: %w", processor.Name, errs[i])
+		}
+	}
+	return summaries, nil
+}
+
+// GetFeeSummary returns the summaries of GetSummary with the fee charged by
+// each processor and the amount left once it is paid. The fee is applied to
+// the total amount, as the processors do in their own summaries.
+func (w *PaymentWorker) GetFeeSummary(ctx context.Context, from, to string) (*models.FeeSummaryResponse, error) {
+	param, err := processSummaryParam(from, to)
+	if err != nil {
+		return nil, err
+	}
+	processors := w.config.GetServices().All()
+	summaries, err := w.summarize(ctx, processors, param)
+	if err != nil {
+		return nil, err
+	}
+	res := &models.FeeSummaryResponse{
+		Processors: make(map[string]*models.PaymentSummary, len(processors)),
+		Total:      &models.PaymentSummary{},
+	}
+	for i, processor := range processors {
+		summary := summaries[i]
+		fee := summary.TotalAmount.MulRate(processor.Fee)
+		res.Processors[processor.Name] = &models.PaymentSummary{
+			RequestCount:      summary.RequestCount,
+			TotalAmount:       summary.TotalAmount,
+			TotalFee:          fee,
+			NetAmount:         summary.TotalAmount.Sub(fee),
+			FeePerTransaction: processor.Fee,
+		}
+		res.Total.RequestCount += summary.RequestCount
+		res.Total.TotalAmount = res.Total.TotalAmount.Add(summary.TotalAmount)
+		res.Total.TotalFee = res.Total.TotalFee.Add(fee)
+	}
+	res.Total.NetAmount = res.Total.TotalAmount.Sub(res.Total.TotalFee)
+	if gross := res.Total.TotalAmount.MinorUnits(); gross != 0 {
+		res.Total.FeePerTransaction = float64(res.Total.TotalFee.MinorUnits()) / float64(gross)
+	}
+	return res, nil
 }
 
+// ErrInvalidSummaryParam is returned for a from/to window that cannot be
+// parsed or is empty.
+var ErrInvalidSummaryParam = errors.New("invalid summary window")
+
 func processSummaryParam(from, to string) (*models.SummaryParam, error) {
 	var res models.SummaryParam
 	var err error
-	if res.StartTime, err = processTime(from, "-inf"); err != nil {
-		return nil, fmt.Errorf("invalid start time format")
+	if res.StartTime, err = processTime(from); err != nil {
+		return nil, fmt.Errorf("%w: from must be an RFC 3339 time", ErrInvalidSummaryParam)
+	}
+	if res.EndTime, err = processTime(to); err != nil {
+		return nil, fmt.Errorf("%w: to must be an RFC 3339 time", ErrInvalidSummaryParam)
 	}
-	if res.EndTime, err = processTime(to, "+inf"); err != nil {
-		return nil, fmt.Errorf("invalid end time format")
+	if !res.StartTime.IsZero() && !res.EndTime.IsZero() && res.EndTime.Before(res.StartTime) {
+		return nil, fmt.Errorf("%w: to must not be before from", ErrInvalidSummaryParam)
 	}
 	return &res, nil
 }
 
-func processTime(param string, value string) (string, error) {
+func processTime(param string) (time.Time, error) {
 	if param == "" {
-		return value, nil
+		return time.Time{}, nil
 	}
-	if timeValue, err := time.Parse(time.RFC3339, param); err == nil {
-		ts := float64(timeValue.UTC().UnixNano()) / 1e9
-		return strconv.FormatFloat(ts, 'f', -1, 64), nil
+	t, err := time.Parse(time.RFC3339, param)
+	if err != nil {
+		return time.Time{}, err
 	}
-	return param, fmt.Errorf("invalid end time format")
+	return t.UTC(), nil
 }
 
-func (w *PaymentWorker) PurgePayments() error {
+func (w *PaymentWorker) PurgePayments(ctx context.Context) error {
 	var wg sync.WaitGroup
-	services := w.config.GetServices()
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		w.purgePaymentProcessor(&services.Default)
-	}()
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		w.purgePaymentProcessor(&services.Fallback)
-	}()
+	for _, processor := range w.config.GetServices().All() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.purgePaymentProcessor(ctx, processor)
+		}()
+	}
+	var purgeErr error
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		w.redis.FlushAll()
+		purgeErr = w.store.Purge(ctx)
 	}()
 	wg.Wait()
-	return nil
+	return purgeErr
 }
 
-func (w *PaymentWorker) purgePaymentProcessor(instance *config.Service) error {
-	if _, _, err := fasthttp.Post(nil, instance.URL+"/admin/purge-payments", nil); err != nil {
-		log.Print("purgePaymentProcessor:ERROR:", instance.Table, "|", err)
+func (w *PaymentWorker) purgePaymentProcessor(ctx context.Context, instance *config.Service) error {
+	if _, err := w.client.Post(ctx, instance.URL+"/admin/purge-payments", nil, instance, ""); err != nil {
+		slog.Error("purge processor payments failed", logging.KeyProcessor, instance.Name, logging.Err(err))
 		return err
 	}
 	return nil
@@ -0,0 +1,51 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"rinha-2025-go/internal/models"
+	"time"
+)
+
+const READINESS_STORE_TIMEOUT = 500 * time.Millisecond
+
+// Readiness tells whether this instance can take traffic: the store answers,
+// a processor is selectable, the workers are not saturated and the shared
+// backlog is below the configured limit.
+func (w *PaymentWorker) Readiness(ctx context.Context) *models.Readiness {
+	res := &models.Readiness{Ready: true}
+	add := func(name string, ok bool, detail string) {
+		res.Checks = append(res.Checks, models.ReadinessCheck{Name: name, OK: ok, Detail: detail})
+		res.Ready = res.Ready && ok
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, READINESS_STORE_TIMEOUT)
+	defer cancel()
+	if err := w.store.Ping(pingCtx); err != nil {
+		add("store", false, err.Error())
+		// Every other check reads the store too.
+		return res
+	}
+	add("store", true, "")
+
+	if instance := w.health.GetActiveInstance(ctx); instance != nil {
+		add("processor", true, instance.Name)
+	} else {
+		add("processor", false, "no processor selectable")
+	}
+
+	// Saturated: every worker is busy and the buffer is past the mark where
+	// ProcessSharedQueue stops pulling.
+	workers, busy := w.Workers(), int(w.busy.Load())
+	buffered, highWater := len(w.paymentChan), cap(w.paymentChan)/2
+	add("workers", busy < workers || buffered < highWater,
+		fmt.Sprintf("%d/%d busy, %d/%d buffered", busy, workers, buffered, cap(w.paymentChan)))
+
+	depth := w.queue.Length(ctx)
+	if limit := w.config.QueueReadyMaxDepth; limit > 0 {
+		add("queue", depth <= limit, fmt.Sprintf("%d/%d pending", depth, limit))
+	} else {
+		add("queue", true, fmt.Sprintf("%d pending", depth))
+	}
+	return res
+}
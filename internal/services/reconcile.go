@@ -0,0 +1,196 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"rinha-2025-go/internal/config"
+	"rinha-2025-go/internal/models"
+	"rinha-2025-go/pkg/logging"
+	"rinha-2025-go/pkg/metrics"
+	"time"
+
+	"github.com/ohler55/ojg/oj"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	RECONCILE_LOCK       = "reconcile_lock"
+	RECONCILE_LOCK_TIME  = "reconcile_lock_time"
+	RECONCILE_REPORT     = "reconcile" // Health field of the last reports
+	RECONCILE_MAX_RANGES = 16          // Mismatched ranges reported per processor at most
+)
+
+// reconcileTimeFormat is the millisecond precision payments are stamped with.
+const reconcileTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+var (
+	reconcileRuns = metrics.NewCounterVec("reconcile_runs_total",
+		"Reconciliations of each processor, by result (match, mismatch or error).", "processor", "result")
+	reconcileRanges = metrics.NewCounterVec("reconcile_mismatched_ranges_total",
+		"Mismatched ranges located by the reconciliation of each processor.", "processor")
+	reconcileMissingRequests = metrics.NewGaugeVec("reconcile_missing_requests",
+		"Payments the processor reports but not the store, over the last reconciled window.", "processor")
+	reconcileMissingAmount = metrics.NewGaugeVec("reconcile_missing_amount",
+		"Amount the processor reports but not the store, over the last reconciled window.", "processor")
+)
+
+// ProcessReconciliation periodically compares the stored summaries with the
+// admin summaries of the processors. A single instance runs it at a time.
+func (w *PaymentWorker) ProcessReconciliation(ctx context.Context) {
+	interval := w.config.Reconcile.Interval
+	for w.sleep(ctx, interval) {
+		locked, err := w.store.TryLock(ctx, RECONCILE_LOCK, w.owner, time.Second+interval)
+		if err != nil {
+			slog.Error("acquire reconcile lock failed", logging.Err(err))
+		}
+		if !locked {
+			continue
+		}
+		lastRun, err := w.store.GetLastRunTime(ctx, RECONCILE_LOCK_TIME)
+		if err != nil {
+			slog.Error("read last reconcile time failed", logging.Err(err))
+		} else if time.Since(lastRun) >= interval {
+			runCtx, cancel := context.WithTimeout(ctx, interval)
+			w.Reconcile(runCtx)
+			cancel()
+			w.store.SetLastRunTime(ctx, RECONCILE_LOCK_TIME, time.Now())
+		}
+		w.store.Unlock(ctx, RECONCILE_LOCK, w.owner)
+	}
+}
+
+// Reconcile checks the sliding window of every processor, shares the
+// reports with the other instances and returns them.
+func (w *PaymentWorker) Reconcile(ctx context.Context) []*models.ReconcileReport {
+	cfg := w.config.Reconcile
+	to := time.Now().UTC().Add(-cfg.Lag).Truncate(time.Millisecond)
+	from := to.Add(-cfg.Window).Add(time.Millisecond)
+	processors := w.config.GetServices().All()
+	reports := make([]*models.ReconcileReport, len(processors))
+	for i, processor := range processors {
+		reports[i] = w.reconcileProcessor(ctx, processor, from, to)
+	}
+	data, err := oj.Marshal(reports)
+	if err != nil {
+		slog.Error("encode reconcile reports failed", logging.Err(err))
+		return reports
+	}
+	if err := w.store.SetHealth(ctx, RECONCILE_REPORT, string(data)); err != nil {
+		slog.Error("save reconcile reports failed", logging.Err(err))
+	}
+	return reports
+}
+
+// ReconcileReports returns the reports of the last reconciliation run by any
+// instance, or nil if none ran yet.
+func (w *PaymentWorker) ReconcileReports(ctx context.Context) ([]*models.ReconcileReport, error) {
+	data, err := w.store.GetHealth(ctx, RECONCILE_REPORT)
+	if err != nil || data == "" {
+		return nil, err
+	}
+	var reports []*models.ReconcileReport
+	if err := oj.Unmarshal([]byte(data), &reports); err != nil {
+		return nil, fmt.Errorf("failed to decode reconcile reports: %w", err)
+	}
+	return reports, nil
+}
+
+func (w *PaymentWorker) reconcileProcessor(ctx context.Context, instance *config.Service, from, to time.Time) *models.ReconcileReport {
+	report := &models.ReconcileReport{Processor: instance.Name, CheckedAt: time.Now().UTC()}
+	window, err := w.compareRange(ctx, instance, from, to)
+	if err == nil {
+		report.Window = *window
+		report.Matched = window.Matches()
+		if !report.Matched {
+			err = w.bisect(ctx, instance, window, &report.Mismatches)
+		}
+	}
+	result := "match"
+	switch {
+	case err != nil:
+		result = "error"
+		report.Error = err.Error()
+		slog.Warn("reconcile failed", logging.KeyProcessor, instance.Name, logging.Err(err))
+	case !report.Matched:
+		result = "mismatch"
+		reconcileRanges.With(instance.Name).Add(uint64(len(report.Mismatches)))
+		slog.Warn("reconcile mismatch", logging.KeyProcessor, instance.Name,
+			"local", report.Window.Local.RequestCount, "remote", report.Window.Remote.RequestCount,
+			"ranges", len(report.Mismatches))
+	}
+	reconcileRuns.With(instance.Name, result).Inc()
+	if err == nil {
+		missing := report.Window.Remote.TotalAmount.Sub(report.Window.Local.TotalAmount)
+		reconcileMissingRequests.With(instance.Name).Set(float64(report.Window.Remote.RequestCount - report.Window.Local.RequestCount))
+		reconcileMissingAmount.With(instance.Name).Set(missing.Float64())
+	}
+	return report
+}
+
+// bisect splits a mismatched range in halves until the differences are
+// narrowed down to ranges shorter than the resolution, which are appended to
+// found. Payments are stamped to the millisecond, so [from, mid] and
+// [mid+1ms, to] cover the range exactly.
+func (w *PaymentWorker) bisect(ctx context.Context, instance *config.Service, r *models.ReconcileRange, found *[]models.ReconcileRange) error {
+	span := r.To.Sub(r.From)
+	if span < w.config.Reconcile.Resolution || span < time.Millisecond {
+		*found = append(*found, *r)
+		return nil
+	}
+	mid := r.From.Add(span / 2).Truncate(time.Millisecond)
+	located := false
+	for _, half := range [][2]time.Time{{r.From, mid}, {mid.Add(time.Millisecond), r.To}} {
+		if len(*found) >= RECONCILE_MAX_RANGES {
+			return nil
+		}
+		sub, err := w.compareRange(ctx, instance, half[0], half[1])
+		if err != nil {
+			return err
+		}
+		if sub.Matches() {
+			continue
+		}
+		located = true
+		if err := w.bisect(ctx, instance, sub, found); err != nil {
+			return err
+		}
+	}
+	if !located {
+		// The halves agree on their own: the difference moved while bisecting.
+		*found = append(*found, *r)
+	}
+	return nil
+}
+
+func (w *PaymentWorker) compareRange(ctx context.Context, instance *config.Service, from, to time.Time) (*models.ReconcileRange, error) {
+	local, err := w.store.GetSummary(ctx, instance, &models.SummaryParam{StartTime: from, EndTime: to})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stored summary: %w", err)
+	}
+	remote, err := w.processorSummary(ctx, instance, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &models.ReconcileRange{From: from, To: to, Local: *local, Remote: *remote}, nil
+}
+
+// processorSummary queries the admin summary of a processor.
+func (w *PaymentWorker) processorSummary(ctx context.Context, instance *config.Service, from, to time.Time) (*models.ProcessorSummary, error) {
+	query := url.Values{}
+	query.Set("from", from.UTC().Format(reconcileTimeFormat))
+	query.Set("to", to.UTC().Format(reconcileTimeFormat))
+	status, body, err := w.client.Get(ctx, instance.URL+"/admin/payments-summary?"+query.Encode(), instance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query processor summary: %w", err)
+	}
+	if status != fasthttp.StatusOK {
+		return nil, fmt.Errorf("processor summary returned status %d", status)
+	}
+	var summary models.ProcessorSummary
+	if err := oj.Unmarshal(body, &summary); err != nil {
+		return nil, fmt.Errorf("failed to decode processor summary: %w", err)
+	}
+	return &summary, nil
+}
@@ -0,0 +1,38 @@
+package services
+
+import (
+	"math/rand/v2"
+	"rinha-2025-go/internal/config"
+	"time"
+)
+
+// retryDelay returns how long to wait before the next attempt of a payment
+// that failed with the given status after attempts tries, or false when it
+// must not be retried. A negative status means the failure did not come from
+// a processor answer and no status rule applies.
+func retryDelay(policy *config.RetryPolicy, status int, attempts int) (time.Duration, bool) {
+	if policy.MaxAttempts > 0 && attempts >= policy.MaxAttempts {
+		return 0, false
+	}
+	base := policy.BaseDelay
+	if rule, ok := policy.Rules[status]; ok && status >= 0 {
+		if rule.NoRetry {
+			return 0, false
+		}
+		base = rule.BaseDelay
+	}
+
+	// Exponential backoff capped at MaxDelay.
+	delay := base
+	for i := 1; i < attempts && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	if policy.Jitter > 0 && delay > 0 {
+		spread := time.Duration(float64(delay) * policy.Jitter)
+		delay = delay - spread + time.Duration(rand.Int64N(int64(spread)+1))
+	}
+	return delay, true
+}
@@ -0,0 +1,77 @@
+package services
+
+import (
+	"rinha-2025-go/internal/config"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	policy := &config.RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    time.Second,
+		Rules: map[int]config.RetryRule{
+			0:   {BaseDelay: 300 * time.Millisecond},
+			422: {NoRetry: true},
+			500: {BaseDelay: 200 * time.Millisecond},
+		},
+	}
+	tests := []struct {
+		name     string
+		status   int
+		attempts int
+		want     time.Duration
+		retry    bool
+	}{
+		{"first attempt", 503, 1, 100 * time.Millisecond, true},
+		{"second attempt doubles", 503, 2, 200 * time.Millisecond, true},
+		{"fourth attempt", 503, 4, 800 * time.Millisecond, true},
+		{"no status", -1, 1, 100 * time.Millisecond, true},
+		{"rule delay", 500, 1, 200 * time.Millisecond, true},
+		{"rule delay doubles", 500, 3, 800 * time.Millisecond, true},
+		{"rule delay capped", 500, 4, time.Second, true},
+		{"no response rule", 0, 2, 600 * time.Millisecond, true},
+		{"never rule", 422, 1, 0, false},
+		{"max attempts", 503, 5, 0, false},
+		{"max attempts before rules", 500, 6, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := retryDelay(policy, tt.status, tt.attempts)
+			if got != tt.want || ok != tt.retry {
+				t.Errorf("retryDelay(%d, %d) = %v, %v, want %v, %v", tt.status, tt.attempts, got, ok, tt.want, tt.retry)
+			}
+		})
+	}
+}
+
+func TestRetryDelayCap(t *testing.T) {
+	policy := &config.RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	// Unlimited attempts must not overflow the doubling.
+	for _, attempts := range []int{5, 64, 1000} {
+		if got, ok := retryDelay(policy, 503, attempts); got != 10*time.Second || !ok {
+			t.Errorf("retryDelay(%d attempts) = %v, %v, want 10s, true", attempts, got, ok)
+		}
+	}
+}
+
+func TestRetryDelayJitter(t *testing.T) {
+	policy := &config.RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second, Jitter: 0.2}
+	tests := []struct {
+		attempts int
+		min, max time.Duration
+	}{
+		{1, 800 * time.Millisecond, time.Second},
+		{3, 3200 * time.Millisecond, 4 * time.Second},
+		{10, 8 * time.Second, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		for range 1000 {
+			got, ok := retryDelay(policy, 503, tt.attempts)
+			if !ok || got < tt.min || got > tt.max {
+				t.Fatalf("retryDelay(%d attempts) = %v, %v, want within [%v, %v]", tt.attempts, got, ok, tt.min, tt.max)
+			}
+		}
+	}
+}
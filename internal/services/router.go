@@ -0,0 +1,117 @@
+package services
+
+import (
+	"math"
+	"rinha-2025-go/internal/config"
+	"time"
+)
+
+const (
+	ROUTER_THRESHOLD = "threshold"
+	ROUTER_COST      = "cost"
+)
+
+// RouteCandidate is what a Router knows about one processor.
+type RouteCandidate struct {
+	Service     *config.Service // Health report in Failing and MinResponseTime
+	BreakerOpen bool
+	Latency     time.Duration // Observed forward latency
+	FailureRate float64       // Observed share of failed forwards (0 to 1)
+}
+
+// Router chooses the processor payments are forwarded to. Candidates come in
+// priority order and queueDepth is the number of payments waiting in the
+// shared queue. It returns nil when no processor can be used.
+type Router interface {
+	Name() string
+	Select(candidates []RouteCandidate, queueDepth int64) *config.Service
+}
+
+func NewRouter(cfg *config.RouterConfig) Router {
+	if cfg.Strategy == ROUTER_COST {
+		return &CostRouter{cfg: cfg}
+	}
+	return &ThresholdRouter{cfg: cfg}
+}
+
+// available filters out failing processors and, unless that leaves nothing,
+// those whose circuit breaker is open.
+func available(candidates []RouteCandidate) []RouteCandidate {
+	var healthy, closed []RouteCandidate
+	for _, c := range candidates {
+		if c.Service.Failing {
+			continue
+		}
+		healthy = append(healthy, c)
+		if !c.BreakerOpen {
+			closed = append(closed, c)
+		}
+	}
+	if len(closed) > 0 {
+		return closed
+	}
+	return healthy
+}
+
+// latency is the worst of the reported and the observed response time.
+func (c *RouteCandidate) latency() time.Duration {
+	reported := time.Duration(c.Service.MinResponseTime) * time.Millisecond
+	return max(reported, c.Latency)
+}
+
+// ThresholdRouter keeps the first processor while its reported response time
+// is under the threshold, and otherwise moves to the first one that is.
+type ThresholdRouter struct {
+	cfg *config.RouterConfig
+}
+
+func (r *ThresholdRouter) Name() string {
+	return ROUTER_THRESHOLD
+}
+
+func (r *ThresholdRouter) Select(candidates []RouteCandidate, queueDepth int64) *config.Service {
+	usable := available(candidates)
+	if len(usable) == 0 {
+		return nil
+	}
+	threshold := r.cfg.LatencyThreshold
+	for _, c := range usable {
+		if time.Duration(c.Service.MinResponseTime)*time.Millisecond <= threshold {
+			return c.Service
+		}
+	}
+	return usable[0].Service
+}
+
+// CostRouter picks the processor with the lowest expected cost per payment:
+// its fee, plus a latency penalty that grows with the queue backlog, plus a
+// penalty for its observed failure rate.
+type CostRouter struct {
+	cfg *config.RouterConfig
+}
+
+func (r *CostRouter) Name() string {
+	return ROUTER_COST
+}
+
+func (r *CostRouter) Select(candidates []RouteCandidate, queueDepth int64) *config.Service {
+	var best *config.Service
+	bestScore := math.Inf(1)
+	for _, c := range available(candidates) {
+		if score := r.score(&c, queueDepth); score < bestScore {
+			best, bestScore = c.Service, score
+		}
+	}
+	return best
+}
+
+func (r *CostRouter) score(c *RouteCandidate, queueDepth int64) float64 {
+	pressure := 1.0
+	if r.cfg.QueueScale > 0 {
+		pressure += float64(queueDepth) / float64(r.cfg.QueueScale)
+	}
+	latency := float64(c.latency()) / float64(r.cfg.LatencyBudget)
+	return c.Service.Fee +
+		r.cfg.LatencyWeight*latency*pressure +
+		r.cfg.FailureWeight*c.FailureRate
+}
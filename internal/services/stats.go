@@ -0,0 +1,98 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"rinha-2025-go/internal/models"
+	"rinha-2025-go/pkg/logging"
+	"sync"
+	"time"
+)
+
+const (
+	STATS_BUCKET    = 5 * time.Second  // Width of a shared statistics bucket
+	STATS_WINDOW    = 12               // Buckets the averages are taken over
+	STATS_HALF_LIFE = 15 * time.Second // Age at which a bucket weighs half
+	STATS_FLUSH     = time.Second      // How often local outcomes are shared
+)
+
+type statsKey struct {
+	table  string
+	bucket int64
+}
+
+// ForwardStats keeps the forward latency and failure rate per processor.
+// Each instance adds its outcomes to time buckets in the store, so the
+// averages cover the forwards of every instance, whichever holds the health
+// lock. Older buckets weigh less and expire after STATS_WINDOW: once a
+// processor gets no traffic, its averages fade out instead of keeping it
+// from being selected again.
+type ForwardStats struct {
+	store   HealthStore
+	mu      sync.Mutex
+	pending map[statsKey]models.ForwardStats // Not yet in the store
+}
+
+func NewForwardStats(store HealthStore) *ForwardStats {
+	return &ForwardStats{store: store, pending: make(map[statsKey]models.ForwardStats)}
+}
+
+func statsBucket(t time.Time) int64 {
+	return t.Truncate(STATS_BUCKET).Unix()
+}
+
+func (s *ForwardStats) Record(table string, success bool, elapsed time.Duration) {
+	key := statsKey{table: table, bucket: statsBucket(time.Now())}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.pending[key]
+	stats.Count++
+	if !success {
+		stats.Failures++
+	}
+	stats.Latency += elapsed
+	s.pending[key] = stats
+}
+
+// Flush adds the outcomes recorded since the last call to the store. They
+// are dropped if the store fails.
+func (s *ForwardStats) Flush(ctx context.Context) {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[statsKey]models.ForwardStats, len(pending))
+	s.mu.Unlock()
+	ttl := STATS_WINDOW * STATS_BUCKET
+	for key, stats := range pending {
+		if err := s.store.AddForwardStats(ctx, key.table, key.bucket, stats, ttl); err != nil {
+			slog.Error("save forward stats failed", logging.KeyProcessor, key.table, logging.Err(err))
+		}
+	}
+}
+
+// Get returns the average latency and failure rate of a processor over the
+// shared buckets, each weighted by its age. Both are zero without forwards.
+func (s *ForwardStats) Get(ctx context.Context, table string) (time.Duration, float64) {
+	now := time.Now()
+	buckets := make([]int64, STATS_WINDOW)
+	for i := range buckets {
+		buckets[i] = statsBucket(now.Add(-time.Duration(i) * STATS_BUCKET))
+	}
+	stats, err := s.store.GetForwardStats(ctx, table, buckets)
+	if err != nil {
+		slog.Error("read forward stats failed", logging.KeyProcessor, table, logging.Err(err))
+		return 0, 0
+	}
+	var count, failures, latency float64
+	for i, bucket := range stats {
+		middle := time.Unix(buckets[i], 0).Add(STATS_BUCKET / 2)
+		weight := math.Exp2(-max(now.Sub(middle), 0).Seconds() / STATS_HALF_LIFE.Seconds())
+		count += weight * float64(bucket.Count)
+		failures += weight * float64(bucket.Failures)
+		latency += weight * float64(bucket.Latency)
+	}
+	if count == 0 {
+		return 0, 0
+	}
+	return time.Duration(latency / count), failures / count
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"rinha-2025-go/internal/config"
+	"rinha-2025-go/internal/models"
+	"time"
+)
+
+// PaymentStore keeps the idempotency record of every accepted payment and
+// the payments that were given up on.
+type PaymentStore interface {
+	// AcceptPayment records a new correlationId and reports false if it was
+	// already known.
+	AcceptPayment(ctx context.Context, paymentID string, ttl time.Duration) (bool, error)
+	// BeginPayment takes the forwarding lease for a payment. It returns the
+	// resulting state (one of models.PAYMENT_STATE_*) and the table of the
+	// processor a previous ambiguous attempt was sent to, if any, or the one
+	// that accepted the payment once it is done.
+	BeginPayment(ctx context.Context, paymentID, owner string, lease, ttl time.Duration) (string, string, error)
+	// PinPayment remembers the processor a payment may already have reached.
+	PinPayment(ctx context.Context, paymentID, table string) error
+	// CompletePayment marks a payment done, accepted by the processor of
+	// table.
+	CompletePayment(ctx context.Context, paymentID, table string) error
+	ReleasePayment(ctx context.Context, paymentID string) error
+
+	SaveDeadLetter(ctx context.Context, entry *models.DeadLetter) error
+	// ListDeadLetters returns dead letters newest first.
+	ListDeadLetters(ctx context.Context, offset, limit int64) ([]*models.DeadLetter, error)
+	// GetDeadLetter returns nil without error when the id is unknown.
+	GetDeadLetter(ctx context.Context, paymentID string) (*models.DeadLetter, error)
+	// RemoveDeadLetter reports whether the entry existed.
+	RemoveDeadLetter(ctx context.Context, paymentID string) (bool, error)
+}
+
+// SummaryStore records the payments each processor accepted.
+type SummaryStore interface {
+	SavePayment(ctx context.Context, instance *config.Service, payment *models.Payment) error
+	GetSummary(ctx context.Context, instance *config.Service, param *models.SummaryParam) (*models.ProcessorSummary, error)
+}
+
+// HealthStore shares the processor health reports, the active processor, the
+// circuit breakers and the forward statistics between instances.
+type HealthStore interface {
+	// SetHealth and GetHealth store an opaque value per field; GetHealth
+	// returns "" for an unknown field.
+	SetHealth(ctx context.Context, field, value string) error
+	GetHealth(ctx context.Context, field string) (string, error)
+	// GetLastRunTime returns the zero time when key was never set.
+	GetLastRunTime(ctx context.Context, key string) (time.Time, error)
+	SetLastRunTime(ctx context.Context, key string, t time.Time) error
+	// RecordBreaker updates the breaker of a processor and returns closed,
+	// open or tripped when this outcome opened it.
+	RecordBreaker(ctx context.Context, table string, success bool, threshold int, openTimeout time.Duration) (string, error)
+	// GetBreaker returns the stored breaker state and when it was last opened.
+	GetBreaker(ctx context.Context, table string) (string, time.Time, error)
+	// AddForwardStats adds to the statistics of a processor for the time
+	// bucket starting at bucket (Unix seconds), which expire after ttl.
+	AddForwardStats(ctx context.Context, table string, bucket int64, stats models.ForwardStats, ttl time.Duration) error
+	// GetForwardStats returns the statistics of each bucket, zero for the
+	// unknown or expired ones.
+	GetForwardStats(ctx context.Context, table string, buckets []int64) ([]models.ForwardStats, error)
+}
+
+// LockManager hands out leases that expire on their own, so a crashed holder
+// does not keep a lock forever.
+type LockManager interface {
+	TryLock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error)
+	// Unlock releases key only if it is still held by owner.
+	Unlock(ctx context.Context, key, owner string) error
+}
+
+// Store is a storage backend shared by the instances of the service.
+type Store interface {
+	PaymentStore
+	SummaryStore
+	HealthStore
+	LockManager
+	Ping(ctx context.Context) error
+	// Purge deletes every payment, summary and health record.
+	Purge(ctx context.Context) error
+	Close() error
+}
+
+// Queue is the backlog of payments waiting to be forwarded, shared by all
+// instances. Payments taken with Dequeue stay pending until Ack or Requeue
+// when the backend supports it; the others ignore QueueID.
+type Queue interface {
+	Enqueue(ctx context.Context, payment *models.Payment) error
+	// EnqueueDelayed schedules a payment to be queued again after delay.
+	EnqueueDelayed(ctx context.Context, payment *models.Payment, delay time.Duration) error
+	// PromoteDue moves up to limit delayed payments that are due into the
+	// queue and returns how many were moved.
+	PromoteDue(ctx context.Context, limit int) (int, error)
+	// Dequeue blocks for a short while waiting for a payment. It returns a
+	// nil payment and a nil error when the queue stayed empty.
+	Dequeue(ctx context.Context) (*models.Payment, error)
+	Ack(ctx context.Context, payment *models.Payment) error
+	// Requeue puts a payment that was taken from the queue, but not
+	// processed, back at its tail.
+	Requeue(ctx context.Context, payment *models.Payment) error
+	// Reclaim re-queues payments abandoned by a crashed consumer and returns
+	// how many were re-queued.
+	Reclaim(ctx context.Context) (int, error)
+	Length(ctx context.Context) int64
+	// Durable reports whether queued payments survive a crash of this
+	// process.
+	Durable() bool
+	Close() error
+}
+
+// Ledger is a SummaryStore kept in its own backend.
+type Ledger interface {
+	SummaryStore
+	Ping(ctx context.Context) error
+	Purge(ctx context.Context) error
+	Close() error
+}
+
+// ledgerStore is a Store whose summaries are kept in a separate ledger.
+type ledgerStore struct {
+	Store
+	ledger Ledger
+}
+
+// WithLedger returns store with the summaries moved to ledger. Ping, Purge
+// and Close apply to both.
+func WithLedger(store Store, ledger Ledger) Store {
+	return &ledgerStore{Store: store, ledger: ledger}
+}
+
+func (s *ledgerStore) SavePayment(ctx context.Context, instance *config.Service, payment *models.Payment) error {
+	return s.ledger.SavePayment(ctx, instance, payment)
+}
+
+func (s *ledgerStore) GetSummary(ctx context.Context, instance *config.Service, param *models.SummaryParam) (*models.ProcessorSummary, error) {
+	return s.ledger.GetSummary(ctx, instance, param)
+}
+
+func (s *ledgerStore) Ping(ctx context.Context) error {
+	return errors.Join(s.Store.Ping(ctx), s.ledger.Ping(ctx))
+}
+
+func (s *ledgerStore) Purge(ctx context.Context) error {
+	return errors.Join(s.Store.Purge(ctx), s.ledger.Purge(ctx))
+}
+
+func (s *ledgerStore) Close() error {
+	return errors.Join(s.ledger.Close(), s.Store.Close())
+}
@@ -0,0 +1,56 @@
+package services
+
+import (
+	"context"
+	"rinha-2025-go/internal/models"
+)
+
+// WaitPayment hands an accepted payment straight to the workers of this
+// instance, rather than possibly to the shared queue, and waits for its
+// final outcome until ctx is done. It returns nil when the outcome is not
+// known by then; the payment is processed all the same. A payment that was
+// already done reports the processor that accepted it, and one another
+// worker is forwarding is looked at again on this instance until that
+// worker is done. Payments retried after a failure only report back if this
+// instance retries them. When ctx
+// is done before a worker of this instance takes the payment, it goes to
+// SubmitPayment instead and may be processed by another instance, so its
+// outcome cannot be reported at all.
+func (w *PaymentWorker) WaitPayment(ctx context.Context, payment *models.Payment) *models.PaymentResult {
+	result := make(chan *models.PaymentResult, 1)
+	w.waiters.Store(payment.PaymentID, result)
+	defer w.waiters.Delete(payment.PaymentID)
+	select {
+	case w.paymentChan <- payment:
+	case <-ctx.Done():
+		w.SubmitPayment(payment)
+		return nil
+	}
+	select {
+	case res := <-result:
+		return res
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// notifyWaiter reports the final outcome of payment to its WaitPayment
+// call, if any.
+func (w *PaymentWorker) notifyWaiter(payment *models.Payment, status, reason string) {
+	waiter, ok := w.waiters.Load(payment.PaymentID)
+	if !ok {
+		return
+	}
+	res := &models.PaymentResult{
+		PaymentID: payment.PaymentID,
+		Status:    status,
+		Processor: payment.Processor,
+		Amount:    payment.Amount,
+		Timestamp: payment.Timestamp,
+		Reason:    reason,
+	}
+	select {
+	case waiter.(chan *models.PaymentResult) <- res:
+	default:
+	}
+}
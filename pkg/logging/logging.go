@@ -0,0 +1,88 @@
+// Package logging sets up the process-wide log/slog logger: leveled, JSON
+// (or text) output on stderr, sampled per message, with a level that can be
+// changed at runtime.
+//
+// Once Init has run, the standard log package writes through the same
+// handler at the info level.
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Level  string // debug, info, warn or error
+	Format string // json or text
+	// SampleInitial is how many records with the same level and message are
+	// logged each second before sampling starts; 0 disables sampling.
+	SampleInitial int
+	// SampleThereafter keeps one record in every SampleThereafter once
+	// SampleInitial is reached; 0 drops the rest of the second.
+	SampleThereafter int
+	Instance         string
+}
+
+// Standard attribute keys.
+const (
+	KeyCorrelationID = "correlationId"
+	KeyProcessor     = "processor"
+	KeyError         = "error"
+)
+
+var level slog.LevelVar
+
+// Init installs the default logger described by cfg.
+func Init(cfg Config) error {
+	lvl, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	level.Set(lvl)
+	opts := &slog.HandlerOptions{Level: &level}
+	var handler slog.Handler
+	switch cfg.Format {
+	case "json", "":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+	if cfg.SampleInitial > 0 {
+		handler = newSamplingHandler(handler, time.Second, cfg.SampleInitial, cfg.SampleThereafter)
+	}
+	logger := slog.New(handler)
+	if cfg.Instance != "" {
+		logger = logger.With("instance", cfg.Instance)
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// ParseLevel reads a level name such as "debug" or "WARN".
+func ParseLevel(s string) (slog.Level, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+	return lvl, nil
+}
+
+// Level returns the current minimum level.
+func Level() slog.Level {
+	return level.Level()
+}
+
+// SetLevel changes the minimum level of the default logger.
+func SetLevel(lvl slog.Level) {
+	level.Set(lvl)
+}
+
+// Err is the attribute used to log an error.
+func Err(err error) slog.Attr {
+	return slog.Any(KeyError, err)
+}
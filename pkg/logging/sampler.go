@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"context"
+	"hash/maphash"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// samplerSlots is the number of counters records are hashed into. Distinct
+// messages sharing a slot are sampled together, which only makes sampling
+// slightly more aggressive.
+const samplerSlots = 4096
+
+type sampleCounter struct {
+	resetAt atomic.Int64
+	count   atomic.Uint64
+}
+
+// inc counts a record at now and returns its position in the current tick.
+func (c *sampleCounter) inc(now, tick int64) uint64 {
+	resetAt := c.resetAt.Load()
+	if now >= resetAt && c.resetAt.CompareAndSwap(resetAt, now+tick) {
+		c.count.Store(1)
+		return 1
+	}
+	return c.count.Add(1)
+}
+
+type sampler struct {
+	seed       maphash.Seed
+	tick       int64
+	initial    uint64
+	thereafter uint64
+	counters   [samplerSlots]sampleCounter
+}
+
+// samplingHandler logs the first records of each level and message in every
+// tick and then one in every thereafter, so a message repeated on the hot
+// path cannot flood the output. It is lock free and does not allocate.
+type samplingHandler struct {
+	slog.Handler
+	s *sampler
+}
+
+func newSamplingHandler(next slog.Handler, tick time.Duration, initial, thereafter int) *samplingHandler {
+	return &samplingHandler{
+		Handler: next,
+		s: &sampler{
+			seed:       maphash.MakeSeed(),
+			tick:       int64(tick),
+			initial:    uint64(initial),
+			thereafter: uint64(thereafter),
+		},
+	}
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if !h.s.keep(r) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), s: h.s}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), s: h.s}
+}
+
+func (s *sampler) keep(r slog.Record) bool {
+	var hash maphash.Hash
+	hash.SetSeed(s.seed)
+	hash.WriteByte(byte(r.Level))
+	hash.WriteString(r.Message)
+	n := s.counters[hash.Sum64()%samplerSlots].inc(r.Time.UnixNano(), s.tick)
+	if n <= s.initial {
+		return true
+	}
+	return s.thereafter > 0 && (n-s.initial)%s.thereafter == 0
+}
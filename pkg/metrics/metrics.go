@@ -0,0 +1,351 @@
+// Package metrics is a small Prometheus text-format exposition library.
+//
+// Updates are lock-free atomics and label lookups on vectors do not allocate
+// once a label combination exists, so metrics can be recorded on the hot
+// path. Everything created with the New* functions is registered in Default.
+package metrics
+
+import (
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefBuckets are latency buckets in seconds, from 0.5ms to 10s.
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	write(b []byte) []byte
+}
+
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+var Default = &Registry{}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteTo writes every registered metric in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := slices.Clone(r.collectors)
+	r.mu.Unlock()
+	var b []byte
+	for _, c := range collectors {
+		b = c.write(b)
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func writeHeader(b []byte, name, help, typ string) []byte {
+	b = append(b, "# HELP "...)
+	b = append(b, name...)
+	b = append(b, ' ')
+	b = append(b, help...)
+	b = append(b, "\n# TYPE "...)
+	b = append(b, name...)
+	b = append(b, ' ')
+	b = append(b, typ...)
+	return append(b, '\n')
+}
+
+func writeSample(b []byte, name, labels string, value float64) []byte {
+	b = append(b, name...)
+	if labels != "" {
+		b = append(b, '{')
+		b = append(b, labels...)
+		b = append(b, '}')
+	}
+	b = append(b, ' ')
+	b = strconv.AppendFloat(b, value, 'g', -1, 64)
+	return append(b, '\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string) string {
+	var sb strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(labelEscaper.Replace(values[i]))
+		sb.WriteByte('"')
+	}
+	return sb.String()
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) writeSamples(b []byte, name, labels string) []byte {
+	return writeSample(b, name, labels, float64(c.v.Load()))
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+func (g *Gauge) Add(v float64) {
+	for {
+		old := g.bits.Load()
+		if g.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (g *Gauge) writeSamples(b []byte, name, labels string) []byte {
+	return writeSample(b, name, labels, math.Float64frombits(g.bits.Load()))
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	buckets []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	sum     Gauge
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]atomic.Uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i].Add(1)
+			break
+		}
+	}
+	h.count.Add(1)
+	h.sum.Add(v)
+}
+
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// Since observes the time elapsed since start.
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) writeSamples(b []byte, name, labels string) []byte {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, upper := range h.buckets {
+		cumulative += h.counts[i].Load()
+		le := labels + sep + `le="` + strconv.FormatFloat(upper, 'g', -1, 64) + `"`
+		b = writeSample(b, name+"_bucket", le, float64(cumulative))
+	}
+	count := h.count.Load()
+	b = writeSample(b, name+"_bucket", labels+sep+`le="+Inf"`, float64(count))
+	b = writeSample(b, name+"_sum", labels, math.Float64frombits(h.sum.bits.Load()))
+	return writeSample(b, name+"_count", labels, float64(count))
+}
+
+type sampler interface {
+	writeSamples(b []byte, name, labels string) []byte
+}
+
+// single is a metric without labels.
+type single[T sampler] struct {
+	name, help, typ string
+	metric          T
+}
+
+func (s *single[T]) write(b []byte) []byte {
+	b = writeHeader(b, s.name, s.help, s.typ)
+	return s.metric.writeSamples(b, s.name, "")
+}
+
+func NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	Default.register(&single[*Counter]{name, help, "counter", c})
+	return c
+}
+
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	Default.register(&single[*Gauge]{name, help, "gauge", g})
+	return g
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	Default.register(&single[*Histogram]{name, help, "histogram", h})
+	return h
+}
+
+// gaugeFunc is a gauge read from a callback at scrape time.
+type gaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+func (g *gaugeFunc) write(b []byte) []byte {
+	b = writeHeader(b, g.name, g.help, "gauge")
+	return writeSample(b, g.name, "", g.fn())
+}
+
+// NewGaugeFunc registers a gauge whose value is computed by fn when scraped.
+func NewGaugeFunc(name, help string, fn func() float64) {
+	Default.register(&gaugeFunc{name, help, fn})
+}
+
+// maxLabels is the most labels a vector can have.
+const maxLabels = 3
+
+type labelKey [maxLabels]string
+
+// vec is a family of metrics partitioned by label values.
+type vec[T sampler] struct {
+	name, help, typ string
+	labels          []string
+	newMetric       func() T
+
+	mu       sync.RWMutex
+	children map[labelKey]T
+}
+
+func newVec[T sampler](name, help, typ string, labels []string, newMetric func() T) *vec[T] {
+	if len(labels) > maxLabels {
+		panic("metrics: too many labels for " + name)
+	}
+	v := &vec[T]{
+		name:      name,
+		help:      help,
+		typ:       typ,
+		labels:    labels,
+		newMetric: newMetric,
+		children:  make(map[labelKey]T),
+	}
+	Default.register(v)
+	return v
+}
+
+func (v *vec[T]) with(values []string) T {
+	var key labelKey
+	copy(key[:], values)
+	v.mu.RLock()
+	m, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return m
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if m, ok = v.children[key]; !ok {
+		m = v.newMetric()
+		v.children[key] = m
+	}
+	return m
+}
+
+func (v *vec[T]) write(b []byte) []byte {
+	v.mu.RLock()
+	keys := make([]labelKey, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	v.mu.RUnlock()
+	slices.SortFunc(keys, func(a, b labelKey) int {
+		return slices.Compare(a[:], b[:])
+	})
+	b = writeHeader(b, v.name, v.help, v.typ)
+	for _, key := range keys {
+		v.mu.RLock()
+		m := v.children[key]
+		v.mu.RUnlock()
+		b = m.writeSamples(b, v.name, formatLabels(v.labels, key[:len(v.labels)]))
+	}
+	return b
+}
+
+type CounterVec struct {
+	v *vec[*Counter]
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newVec(name, help, "counter", labels, func() *Counter { return &Counter{} })}
+}
+
+// With returns the counter for the given label values, in label order.
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.v.with(values)
+}
+
+type GaugeVec struct {
+	v *vec[*Gauge]
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newVec(name, help, "gauge", labels, func() *Gauge { return &Gauge{} })}
+}
+
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return g.v.with(values)
+}
+
+type HistogramVec struct {
+	v *vec[*Histogram]
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{newVec(name, help, "histogram", labels, func() *Histogram { return newHistogram(buckets) })}
+}
+
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.v.with(values)
+}
+
+// statusLabels caches the label text of HTTP status codes.
+var statusLabels = func() [600]string {
+	var labels [600]string
+	for i := range labels {
+		labels[i] = strconv.Itoa(i)
+	}
+	return labels
+}()
+
+// StatusLabel returns the label value of an HTTP status code without
+// allocating.
+func StatusLabel(code int) string {
+	if code >= 0 && code < len(statusLabels) {
+		return statusLabels[code]
+	}
+	return strconv.Itoa(code)
+}
@@ -0,0 +1,218 @@
+// Package tracing records spans and exports them in the OTLP/JSON format,
+// either as JSON lines to a local file or to an OTLP/HTTP collector.
+//
+// Trace context travels as a W3C traceparent string. When tracing is not
+// enabled Start returns nil and every Span method is a no-op, so callers
+// never need to check.
+package tracing
+
+import (
+	"encoding/hex"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+type Kind int
+
+// Span kinds, numbered as in OTLP.
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+	KindProducer Kind = 4
+	KindConsumer Kind = 5
+)
+
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent formats the context as a W3C traceparent header value, or
+// returns "" for an invalid context.
+func (sc SpanContext) TraceParent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	var b [55]byte
+	copy(b[:], "00-")
+	hex.Encode(b[3:35], sc.TraceID[:])
+	b[35] = '-'
+	hex.Encode(b[36:52], sc.SpanID[:])
+	copy(b[52:], "-00")
+	if sc.Sampled {
+		b[54] = '1'
+	}
+	return string(b[:])
+}
+
+// ParseTraceParent reads a W3C traceparent value. Malformed values yield an
+// invalid context.
+func ParseTraceParent(value string) SpanContext {
+	var sc SpanContext
+	if len(value) != 55 || value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return SpanContext{}
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(value[3:35])); err != nil {
+		return SpanContext{}
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(value[36:52])); err != nil {
+		return SpanContext{}
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(value[53:55])); err != nil {
+		return SpanContext{}
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc
+}
+
+type attribute struct {
+	key   string
+	str   string
+	num   int64
+	isNum bool
+}
+
+type Span struct {
+	name     string
+	kind     Kind
+	ctx      SpanContext
+	parentID [8]byte
+	start    time.Time
+	end      time.Time
+	attrs    []attribute
+	errMsg   string
+	failed   bool
+	ended    atomic.Bool
+}
+
+type Config struct {
+	Exporter    string // "" (disabled), "file" or "otlp"
+	File        string // Path of the JSON lines file for the file exporter
+	Endpoint    string // OTLP/HTTP traces URL, e.g. http://collector:4318/v1/traces
+	SampleRatio float64
+	ServiceName string
+	Instance    string
+}
+
+type tracer struct {
+	cfg      Config
+	exporter *exporter
+}
+
+var active atomic.Pointer[tracer]
+
+// Init enables tracing with cfg. It is a no-op when no exporter is set.
+func Init(cfg Config) error {
+	if cfg.Exporter == "" {
+		return nil
+	}
+	exp, err := newExporter(cfg)
+	if err != nil {
+		return err
+	}
+	active.Store(&tracer{cfg: cfg, exporter: exp})
+	return nil
+}
+
+// Shutdown flushes pending spans and disables tracing.
+func Shutdown() {
+	if t := active.Swap(nil); t != nil {
+		t.exporter.close()
+	}
+}
+
+// Start begins a span as a child of parent, or as a new trace when parent is
+// invalid. New traces are sampled according to the configured ratio;
+// children follow their parent's decision.
+func Start(name string, kind Kind, parent SpanContext) *Span {
+	t := active.Load()
+	if t == nil {
+		return nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now()}
+	if parent.IsValid() {
+		s.ctx.TraceID = parent.TraceID
+		s.ctx.Sampled = parent.Sampled
+		s.parentID = parent.SpanID
+	} else {
+		randomBytes(s.ctx.TraceID[:])
+		s.ctx.Sampled = rand.Float64() < t.cfg.SampleRatio
+	}
+	randomBytes(s.ctx.SpanID[:])
+	return s
+}
+
+// StartFrom begins a span whose parent is given as a traceparent string.
+func StartFrom(name string, kind Kind, traceParent string) *Span {
+	if active.Load() == nil {
+		return nil
+	}
+	return Start(name, kind, ParseTraceParent(traceParent))
+}
+
+func randomBytes(b []byte) {
+	for i := 0; i < len(b); i += 8 {
+		v := rand.Uint64()
+		for j := i; j < len(b) && j < i+8; j++ {
+			b[j] = byte(v)
+			v >>= 8
+		}
+	}
+}
+
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.ctx
+}
+
+// TraceParent returns the traceparent to hand to children of this span.
+func (s *Span) TraceParent() string {
+	return s.Context().TraceParent()
+}
+
+func (s *Span) SetString(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, attribute{key: key, str: value})
+}
+
+func (s *Span) SetInt(key string, value int64) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, attribute{key: key, num: value, isNum: true})
+}
+
+// SetError marks the span as failed. A nil error is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.failed = true
+	s.errMsg = err.Error()
+}
+
+// End finishes the span and hands it to the exporter if it is sampled.
+func (s *Span) End() {
+	if s == nil || s.ended.Swap(true) {
+		return
+	}
+	s.end = time.Now()
+	if !s.ctx.Sampled {
+		return
+	}
+	if t := active.Load(); t != nil {
+		t.exporter.add(s)
+	}
+}
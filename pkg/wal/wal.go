@@ -0,0 +1,431 @@
+// Package wal is an append-only write-ahead log of opaque records, kept in
+// numbered segment files in one directory.
+//
+// Every record has a sequence number and a CRC-32C checksum. Records are
+// acknowledged once their content is safe elsewhere; a segment is deleted
+// when it and every older segment hold no unacknowledged record. Open
+// returns the records left unacknowledged by the previous run, stopping at
+// the first torn or corrupt record of each segment.
+package wal
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sync policies.
+const (
+	SyncAlways   = "always"   // Append returns once the record is on disk
+	SyncInterval = "interval" // Records are synced every SyncInterval
+	SyncNone     = "none"     // Syncing is left to the operating system
+)
+
+type Config struct {
+	Dir          string // Directory of the segment files; "" disables the log
+	Sync         string
+	SyncInterval time.Duration
+	SegmentSize  int64 // Size past which a new segment is started
+}
+
+// Record is an appended entry that was not acknowledged.
+type Record struct {
+	Seq  uint64
+	Data []byte
+}
+
+const (
+	kindAppend byte = 1
+	kindAck    byte = 2
+	kindMark   byte = 3 // Starts a segment with the last sequence used
+
+	headerSize    = 4 + 4 + 1 + 8 // checksum, length, kind, sequence
+	maxRecordSize = 1 << 20
+	segmentExt    = ".wal"
+)
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+	ErrClosed  = errors.New("wal: log is closed")
+)
+
+type segment struct {
+	id      uint64
+	path    string
+	pending int // Unacknowledged appends
+}
+
+type Log struct {
+	cfg Config
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	segments []*segment          // Oldest first, the last one being written
+	pending  map[uint64]*segment // Segment of each unacknowledged append
+	next     uint64
+	closed   bool
+
+	syncMu sync.Mutex
+	synced atomic.Uint64 // Every append up to this sequence is on disk
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open reads the segments found in cfg.Dir and starts a new one. It returns
+// the unacknowledged records, oldest first; they stay pending until Ack.
+func Open(cfg Config) (*Log, []Record, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, nil, fmt.Errorf("wal: %w", err)
+	}
+	l := &Log{
+		cfg:     cfg,
+		pending: make(map[uint64]*segment),
+		next:    1,
+		done:    make(chan struct{}),
+	}
+	records, err := l.replay()
+	if err != nil {
+		return nil, nil, err
+	}
+	var lastID uint64
+	if n := len(l.segments); n > 0 {
+		lastID = l.segments[n-1].id
+	}
+	if err := l.openSegment(lastID + 1); err != nil {
+		return nil, nil, err
+	}
+	l.synced.Store(l.next - 1)
+	l.compact()
+	if cfg.Sync == SyncInterval {
+		l.wg.Add(1)
+		go l.syncLoop()
+	}
+	return l, records, nil
+}
+
+func segmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%s", id, segmentExt))
+}
+
+func (l *Log) replay() ([]Record, error) {
+	entries, err := os.ReadDir(l.cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("wal: %w", err)
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), segmentExt)
+		if !ok {
+			continue
+		}
+		id, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		l.segments = append(l.segments, &segment{id: id, path: filepath.Join(l.cfg.Dir, entry.Name())})
+	}
+	slices.SortFunc(l.segments, func(a, b *segment) int {
+		return cmp.Compare(a.id, b.id)
+	})
+
+	appended := make(map[uint64]Record)
+	for _, seg := range l.segments {
+		if err := l.readSegment(seg, appended); err != nil {
+			return nil, err
+		}
+	}
+	records := make([]Record, 0, len(appended))
+	for _, record := range appended {
+		records = append(records, record)
+	}
+	slices.SortFunc(records, func(a, b Record) int {
+		return cmp.Compare(a.Seq, b.Seq)
+	})
+	return records, nil
+}
+
+// readSegment adds the appends of seg to appended and removes the ones it
+// acknowledges.
+func (l *Log) readSegment(seg *segment, appended map[uint64]Record) error {
+	data, err := os.ReadFile(seg.path)
+	if err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	for offset := 0; offset < len(data); {
+		kind, seq, payload, n := decode(data[offset:])
+		if n == 0 {
+			slog.Warn("wal: ignoring torn or corrupt tail", "segment", seg.path,
+				"offset", offset, "bytes", len(data)-offset)
+			break
+		}
+		offset += n
+		l.next = max(l.next, seq+1)
+		switch kind {
+		case kindAppend:
+			appended[seq] = Record{Seq: seq, Data: payload}
+			l.pending[seq] = seg
+			seg.pending++
+		case kindAck:
+			if owner, ok := l.pending[seq]; ok {
+				delete(appended, seq)
+				delete(l.pending, seq)
+				owner.pending--
+			}
+		}
+	}
+	return nil
+}
+
+// decode reads one record from b. It returns n == 0 when b does not start
+// with a whole, valid record.
+func decode(b []byte) (kind byte, seq uint64, payload []byte, n int) {
+	if len(b) < headerSize {
+		return 0, 0, nil, 0
+	}
+	sum := binary.LittleEndian.Uint32(b[0:4])
+	length := int(binary.LittleEndian.Uint32(b[4:8]))
+	if length > maxRecordSize || len(b) < headerSize+length {
+		return 0, 0, nil, 0
+	}
+	if crc32.Checksum(b[8:headerSize+length], castagnoli) != sum {
+		return 0, 0, nil, 0
+	}
+	kind = b[8]
+	seq = binary.LittleEndian.Uint64(b[9:17])
+	payload = slices.Clone(b[headerSize : headerSize+length])
+	return kind, seq, payload, headerSize + length
+}
+
+func encode(kind byte, seq uint64, payload []byte) []byte {
+	b := make([]byte, headerSize+len(payload))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(len(payload)))
+	b[8] = kind
+	binary.LittleEndian.PutUint64(b[9:17], seq)
+	copy(b[headerSize:], payload)
+	binary.LittleEndian.PutUint32(b[0:4], crc32.Checksum(b[8:], castagnoli))
+	return b
+}
+
+// openSegment starts segment id. It must be called with mu held.
+func (l *Log) openSegment(id uint64) error {
+	path := segmentPath(l.cfg.Dir, id)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	if err := syncDir(l.cfg.Dir); err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = 0
+	l.segments = append(l.segments, &segment{id: id, path: path})
+	// Older segments may all be compacted away before anything is appended
+	// to this one; the mark keeps sequence numbers from starting over.
+	if l.next > 1 {
+		return l.write(kindMark, l.next-1, nil)
+	}
+	return nil
+}
+
+// syncDir makes the creation or removal of a segment durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	return nil
+}
+
+// rotate syncs and closes the current segment and starts the next one. It
+// must be called with mu held.
+func (l *Log) rotate() error {
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	l.markSynced(l.next - 1)
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	return l.openSegment(l.segments[len(l.segments)-1].id + 1)
+}
+
+func (l *Log) markSynced(seq uint64) {
+	for {
+		current := l.synced.Load()
+		if current >= seq || l.synced.CompareAndSwap(current, seq) {
+			return
+		}
+	}
+}
+
+// Append writes data as a new record and returns its sequence number. With
+// the always policy it returns once the record is on disk; concurrent
+// appends share the same sync.
+func (l *Log) Append(data []byte) (uint64, error) {
+	if len(data) > maxRecordSize {
+		return 0, fmt.Errorf("wal: record of %d bytes is too large", len(data))
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return 0, ErrClosed
+	}
+	if l.size >= l.cfg.SegmentSize && l.cfg.SegmentSize > 0 {
+		if err := l.rotate(); err != nil {
+			l.mu.Unlock()
+			return 0, err
+		}
+	}
+	seq := l.next
+	if err := l.write(kindAppend, seq, data); err != nil {
+		l.mu.Unlock()
+		return 0, err
+	}
+	l.next++
+	seg := l.segments[len(l.segments)-1]
+	seg.pending++
+	l.pending[seq] = seg
+	l.mu.Unlock()
+
+	if l.cfg.Sync == SyncAlways {
+		if err := l.syncTo(seq); err != nil {
+			return 0, err
+		}
+	}
+	return seq, nil
+}
+
+// write appends one record to the current segment. It must be called with
+// mu held.
+func (l *Log) write(kind byte, seq uint64, payload []byte) error {
+	n, err := l.file.Write(encode(kind, seq, payload))
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	return nil
+}
+
+// syncTo returns once every record up to seq is on disk.
+func (l *Log) syncTo(seq uint64) error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	if l.synced.Load() >= seq {
+		return nil
+	}
+	l.mu.Lock()
+	file, last := l.file, l.next-1
+	l.mu.Unlock()
+	if err := file.Sync(); err != nil {
+		if errors.Is(err, os.ErrClosed) && l.synced.Load() >= seq {
+			// Rotated meanwhile, which synced the record.
+			return nil
+		}
+		return fmt.Errorf("wal: %w", err)
+	}
+	l.markSynced(last)
+	return nil
+}
+
+func (l *Log) syncLoop() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(l.cfg.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			last := l.next - 1
+			l.mu.Unlock()
+			if err := l.syncTo(last); err != nil {
+				slog.Error("wal: sync failed", "error", err)
+			}
+		}
+	}
+}
+
+// Ack marks a record as no longer needed. Unknown or already acknowledged
+// sequence numbers are ignored. Acknowledgements are not synced on their
+// own: one lost in a crash only makes its record be replayed again.
+func (l *Log) Ack(seq uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	seg, ok := l.pending[seq]
+	if !ok {
+		return nil
+	}
+	if err := l.write(kindAck, seq, nil); err != nil {
+		return err
+	}
+	delete(l.pending, seq)
+	seg.pending--
+	l.compact()
+	return nil
+}
+
+// compact deletes the oldest segments while they hold nothing pending. It
+// must be called with mu held.
+func (l *Log) compact() {
+	removed := false
+	for len(l.segments) > 1 && l.segments[0].pending == 0 {
+		if err := os.Remove(l.segments[0].path); err != nil && !os.IsNotExist(err) {
+			slog.Error("wal: remove segment failed", "segment", l.segments[0].path, "error", err)
+			return
+		}
+		l.segments = l.segments[1:]
+		removed = true
+	}
+	if removed {
+		if err := syncDir(l.cfg.Dir); err != nil {
+			slog.Error("wal: sync directory failed", "error", err)
+		}
+	}
+}
+
+// Pending returns the number of unacknowledged records.
+func (l *Log) Pending() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.pending)
+}
+
+// Close syncs and closes the current segment.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.mu.Unlock()
+	close(l.done)
+	l.wg.Wait()
+
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return errors.Join(l.file.Sync(), l.file.Close())
+}
@@ -0,0 +1,226 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func openLog(t *testing.T, dir string, segmentSize int64) (*Log, []Record) {
+	t.Helper()
+	l, records, err := Open(Config{Dir: dir, Sync: SyncAlways, SegmentSize: segmentSize})
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l, records
+}
+
+func appendAll(t *testing.T, l *Log, data ...string) []uint64 {
+	t.Helper()
+	var seqs []uint64
+	for _, d := range data {
+		seq, err := l.Append([]byte(d))
+		if err != nil {
+			t.Fatalf("Append(%q) error: %v", d, err)
+		}
+		seqs = append(seqs, seq)
+	}
+	return seqs
+}
+
+func ack(t *testing.T, l *Log, seqs ...uint64) {
+	t.Helper()
+	for _, seq := range seqs {
+		if err := l.Ack(seq); err != nil {
+			t.Fatalf("Ack(%d) error: %v", seq, err)
+		}
+	}
+}
+
+func closeLog(t *testing.T, l *Log) {
+	t.Helper()
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(files)
+	return files
+}
+
+func recordData(records []Record) []string {
+	var data []string
+	for _, r := range records {
+		data = append(data, fmt.Sprintf("%d:%s", r.Seq, r.Data))
+	}
+	return data
+}
+
+func TestReplayPending(t *testing.T) {
+	dir := t.TempDir()
+	l, records := openLog(t, dir, 0)
+	if len(records) != 0 {
+		t.Fatalf("new log replayed %v", recordData(records))
+	}
+	seqs := appendAll(t, l, "a", "b", "c")
+	if !slices.Equal(seqs, []uint64{1, 2, 3}) {
+		t.Fatalf("sequences = %v, want [1 2 3]", seqs)
+	}
+	ack(t, l, 2, 2, 42) // Repeated and unknown acks are ignored
+	if l.Pending() != 2 {
+		t.Errorf("Pending() = %d, want 2", l.Pending())
+	}
+	closeLog(t, l)
+
+	l, records = openLog(t, dir, 0)
+	if got, want := recordData(records), []string{"1:a", "3:c"}; !slices.Equal(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+	if l.Pending() != 2 {
+		t.Errorf("Pending() after reopen = %d, want 2", l.Pending())
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := openLog(t, dir, 0)
+	appendAll(t, l, "first", "second")
+	closeLog(t, l)
+
+	files := segmentFiles(t, dir)
+	info, err := os.Stat(files[len(files)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A crash in the middle of writing the second record.
+	if err := os.Truncate(files[len(files)-1], info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	l, records := openLog(t, dir, 0)
+	if got, want := recordData(records), []string{"1:first"}; !slices.Equal(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+	if seqs := appendAll(t, l, "third"); seqs[0] != 2 {
+		t.Errorf("sequence after torn tail = %d, want 2", seqs[0])
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := openLog(t, dir, 0)
+	appendAll(t, l, "first", "second", "third")
+	closeLog(t, l)
+
+	files := segmentFiles(t, dir)
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a byte in the payload of the second record: it and everything
+	// after it in the segment are ignored.
+	offset := headerSize + len("first") + headerSize
+	data[offset] ^= 0xff
+	if err := os.WriteFile(files[0], data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, records := openLog(t, dir, 0)
+	if got, want := recordData(records), []string{"1:first"}; !slices.Equal(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+}
+
+func TestAckAcrossRotation(t *testing.T) {
+	dir := t.TempDir()
+	// Every append past the first starts a new segment.
+	l, _ := openLog(t, dir, 1)
+	appendAll(t, l, "a", "b", "c", "d")
+	if n := len(segmentFiles(t, dir)); n != 4 {
+		t.Fatalf("%d segments, want 4", n)
+	}
+	// Acks of records in older segments are written to the current one.
+	ack(t, l, 2, 3)
+	closeLog(t, l)
+
+	l, records := openLog(t, dir, 1)
+	if got, want := recordData(records), []string{"1:a", "4:d"}; !slices.Equal(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+	ack(t, l, 1, 4)
+	closeLog(t, l)
+
+	_, records = openLog(t, dir, 1)
+	if len(records) != 0 {
+		t.Errorf("replayed %v after every ack", recordData(records))
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := openLog(t, dir, 1)
+	appendAll(t, l, "a", "b", "c")
+	files := segmentFiles(t, dir)
+
+	// The oldest segment still holds a pending record: nothing is deleted.
+	ack(t, l, 2)
+	if got := segmentFiles(t, dir); !slices.Equal(got, files) {
+		t.Errorf("segments after acking a newer record = %v, want %v", got, files)
+	}
+	// The first two segments are then done with, the last is being written.
+	ack(t, l, 1)
+	if got := segmentFiles(t, dir); !slices.Equal(got, files[2:]) {
+		t.Errorf("segments after acking the oldest records = %v, want %v", got, files[2:])
+	}
+	ack(t, l, 3)
+	if got := segmentFiles(t, dir); !slices.Equal(got, files[2:]) {
+		t.Errorf("segments after acking every record = %v, want %v", got, files[2:])
+	}
+	closeLog(t, l)
+
+	// Reopening starts a new segment and drops the finished one.
+	openLog(t, dir, 1)
+	if got := segmentFiles(t, dir); len(got) != 1 || got[0] == files[2] {
+		t.Errorf("segments after reopen = %v, want a single new one", got)
+	}
+}
+
+func TestSequenceAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := openLog(t, dir, 1)
+	seqs := appendAll(t, l, "a", "b", "c")
+	ack(t, l, seqs...)
+	closeLog(t, l)
+
+	// Reopen twice without appending: every segment holding records gets
+	// compacted away.
+	for range 2 {
+		l, records := openLog(t, dir, 1)
+		if len(records) != 0 {
+			t.Fatalf("replayed %v", recordData(records))
+		}
+		closeLog(t, l)
+	}
+	l, _ = openLog(t, dir, 1)
+	if got := appendAll(t, l, "d"); got[0] != 4 {
+		t.Errorf("sequence after reopen = %d, want 4", got[0])
+	}
+}
+
+func TestClosed(t *testing.T) {
+	l, _ := openLog(t, t.TempDir(), 0)
+	closeLog(t, l)
+	if _, err := l.Append([]byte("a")); err != ErrClosed {
+		t.Errorf("Append() after Close = %v, want ErrClosed", err)
+	}
+	if err := l.Ack(1); err != ErrClosed {
+		t.Errorf("Ack() after Close = %v, want ErrClosed", err)
+	}
+}